@@ -0,0 +1,90 @@
+//
+// Event address list encodings.  By default, GEOIP_ADDR_ENCODING=prefixed,
+// address list entries are strings like "ipv4:1.2.3.4".  With "object",
+// entries are objects like {"type": "ipv4", "addr": "1.2.3.4"}, with the keys
+// set by GEOIP_ADDR_TYPE_KEY and GEOIP_ADDR_VALUE_KEY.  Objects are read as
+// the string "<type>:<addr>", so GEOIP_ADDR_PREFIXES applies to both, and
+// written back as objects.  Other keys in address objects aren't kept.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Address list encoding, "prefixed" or "object", and the object keys.
+var (
+	addrEncoding = "prefixed"
+	addrTypeKey  = "type"
+	addrValueKey = "addr"
+)
+
+// An event address list, as prefixed strings whatever the encoding.
+type addrList []string
+
+func (l *addrList) UnmarshalJSON(data []byte) error {
+
+	if addrEncoding != "object" {
+		return json.Unmarshal(data, (*[]string)(l))
+	}
+
+	// Strings are accepted too, as they are.
+	var entries []json.RawMessage
+	err := json.Unmarshal(data, &entries)
+	if err != nil {
+		return err
+	}
+
+	addrs := make(addrList, 0, len(entries))
+	for _, e := range entries {
+
+		var v string
+		if json.Unmarshal(e, &v) == nil {
+			addrs = append(addrs, v)
+			continue
+		}
+
+		var obj map[string]interface{}
+		err := json.Unmarshal(e, &obj)
+		if err != nil {
+			return fmt.Errorf("bad address entry: %s", string(e))
+		}
+		typ, _ := obj[addrTypeKey].(string)
+		addr, _ := obj[addrValueKey].(string)
+		if typ == "" {
+			addrs = append(addrs, addr)
+		} else {
+			addrs = append(addrs, typ+":"+addr)
+		}
+
+	}
+
+	*l = addrs
+	return nil
+
+}
+
+func (l addrList) MarshalJSON() ([]byte, error) {
+
+	if addrEncoding != "object" {
+		return json.Marshal([]string(l))
+	}
+
+	objs := make([]map[string]string, 0, len(l))
+	for _, v := range l {
+		kv := strings.SplitN(v, ":", 2)
+		if len(kv) == 2 && net.ParseIP(v) == nil {
+			objs = append(objs, map[string]string{
+				addrTypeKey: kv[0], addrValueKey: kv[1],
+			})
+		} else {
+			objs = append(objs, map[string]string{addrValueKey: v})
+		}
+	}
+	return json.Marshal(objs)
+
+}
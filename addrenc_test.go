@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// Address lists decode to prefixed strings and encode back in the configured
+// encoding.
+func TestAddrListRoundTrip(t *testing.T) {
+
+	oldEncoding, oldType, oldValue := addrEncoding, addrTypeKey, addrValueKey
+	defer func() {
+		addrEncoding, addrTypeKey, addrValueKey = oldEncoding, oldType,
+			oldValue
+	}()
+
+	for _, c := range []struct {
+		name     string
+		encoding string
+		typeKey  string
+		valueKey string
+		in       string
+		addrs    addrList
+		out      string
+	}{
+		{"prefixed strings", "prefixed", "type", "addr",
+			`["ipv4:1.2.3.4","tcp:443"]`,
+			addrList{"ipv4:1.2.3.4", "tcp:443"},
+			`["ipv4:1.2.3.4","tcp:443"]`},
+		{"objects", "object", "type", "addr",
+			`[{"type":"ipv4","addr":"1.2.3.4"},{"type":"tcp","addr":"443"}]`,
+			addrList{"ipv4:1.2.3.4", "tcp:443"},
+			`[{"addr":"1.2.3.4","type":"ipv4"},{"addr":"443","type":"tcp"}]`},
+		{"custom keys", "object", "kind", "value",
+			`[{"kind":"ipv6","value":"2001:db8::1","extra":1}]`,
+			addrList{"ipv6:2001:db8::1"},
+			`[{"kind":"ipv6","value":"2001:db8::1"}]`},
+		{"mixed", "object", "type", "addr",
+			`["ipv4:1.2.3.4",{"addr":"2001:db8::1"}]`,
+			addrList{"ipv4:1.2.3.4", "2001:db8::1"},
+			`[{"addr":"1.2.3.4","type":"ipv4"},{"addr":"2001:db8::1"}]`},
+	} {
+
+		addrEncoding, addrTypeKey, addrValueKey = c.encoding, c.typeKey,
+			c.valueKey
+
+		var l addrList
+		err := json.Unmarshal([]byte(c.in), &l)
+		if err != nil {
+			t.Errorf("%s: decode: %s", c.name, err.Error())
+			continue
+		}
+		if !reflect.DeepEqual(l, c.addrs) {
+			t.Errorf("%s: decoded %q", c.name, l)
+		}
+
+		j, err := json.Marshal(l)
+		if err != nil {
+			t.Errorf("%s: encode: %s", c.name, err.Error())
+			continue
+		}
+		if string(j) != c.out {
+			t.Errorf("%s: encoded %s", c.name, j)
+		}
+
+	}
+
+	// Neither a string nor an object, or not a list at all.
+	for _, c := range []struct {
+		encoding string
+		in       string
+	}{
+		{"object", `[1]`},
+		{"object", `["ipv4:1.2.3.4",[]]`},
+		{"object", `{"type":"ipv4","addr":"1.2.3.4"}`},
+		{"prefixed", `[{"type":"ipv4","addr":"1.2.3.4"}]`},
+	} {
+		addrEncoding, addrTypeKey, addrValueKey = c.encoding, "type", "addr"
+		var l addrList
+		if json.Unmarshal([]byte(c.in), &l) == nil {
+			t.Errorf("%s, %s: decoded as %q", c.encoding, c.in, l)
+		}
+	}
+
+}
@@ -0,0 +1,80 @@
+//
+// Country in which each autonomous system is registered.  GeoLite2-ASN has
+// no country, so this comes from a CSV file of "ASN,ISO" lines, e.g. derived
+// from RIR delegation data.
+//
+// An address which geolocates outside its ASN's country is often cloud, VPN
+// or misrouted traffic.  Such addresses are counted, logged and, with
+// GEOIP_COUNTRY_ASN_MISMATCH, flagged in their location.
+//
+
+package main
+
+import (
+	"encoding/csv"
+	"expvar"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Event addresses which geolocate outside their ASN's country.
+var countryASNMismatches = expvar.NewInt("geoip_country_asn_mismatches")
+
+// Load an ASN to ISO 3166-1 alpha-2 country table.
+func loadASNCountries(filename string) (map[uint]string, error) {
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = 2
+	r.Comment = '#'
+	recs, err := r.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	table := make(map[uint]string, len(recs))
+	for _, rec := range recs {
+		v := strings.TrimPrefix(strings.TrimSpace(rec[0]), "AS")
+		asn, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("%s: bad ASN: %s", filename, rec[0])
+		}
+		table[uint(asn)] = strings.ToUpper(strings.TrimSpace(rec[1]))
+	}
+
+	return table, nil
+
+}
+
+// Physical country of a place, whichever is primary.
+func (s *work) physicalIsoCode(p *place) string {
+	if s.registeredCountry {
+		return p.PhysicalIsoCode
+	}
+	return p.IsoCode
+}
+
+// Whether a place geolocates outside its ASN's country.  False if either
+// country is unknown.
+func (s *work) countryASNMismatch(p *place) bool {
+	iso := s.physicalIsoCode(p)
+	return iso != "" && p.ASCountry != "" && iso != p.ASCountry
+}
+
+// Count and log event addresses outside their ASN's country.
+func (s *work) checkCountryASN(loc *locationInfo) {
+	for _, p := range []*place{loc.Src, loc.Dest} {
+		if p != nil && s.countryASNMismatch(p) {
+			countryASNMismatches.Add(1)
+			s.errLog.log("AS%d, registered in %s, has addresses in %s",
+				p.ASNum, p.ASCountry, s.physicalIsoCode(p))
+		}
+	}
+}
@@ -0,0 +1,60 @@
+//
+// Fallback names for autonomous systems whose ASN database record has no
+// organisation.  The file is in the form of the RIPE NCC "asn.txt" AS names
+// dataset: an ASN, a space and the name on each line, e.g.
+//
+//   15169 GOOGLE - Google LLC, US
+//
+// An empty name, or "-Reserved AS-" style placeholder, leaves ASOrg empty.
+//
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Load an ASN to name table.
+func loadASNNames(filename string) (map[uint]string, error) {
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	table := map[uint]string{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.SplitN(line, " ", 2)
+		v := strings.TrimPrefix(fields[0], "AS")
+		asn, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: bad ASN: %s", filename, n,
+				fields[0])
+		}
+		if len(fields) < 2 {
+			continue
+		}
+
+		name := strings.TrimSpace(fields[1])
+		if name == "" || strings.HasPrefix(name, "-") {
+			continue
+		}
+		table[uint(asn)] = name
+
+	}
+
+	return table, scanner.Err()
+
+}
@@ -0,0 +1,85 @@
+//
+// Number of networks each ASN has in the ASN database, as a rough measure of
+// provider scale.  Counted by walking the database whenever it is opened,
+// so the figures follow database updates.
+//
+
+package main
+
+import (
+	"net"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+// IPv6 ranges which alias the IPv4 part of an IPv6 database: IPv4-mapped,
+// 6to4 and Teredo.  Networks under them are counted in the IPv4 part.
+var ipv4Aliases = parseCIDRs("::ffff:0:0/96", "2002::/16", "2001::/32")
+
+// Count networks by ASN.
+func countASNPrefixes(r *maxminddb.Reader) (map[uint]int, error) {
+
+	counts := map[uint]int{}
+
+	nets := r.Networks()
+	for nets.Next() {
+
+		// Decoding leaves fields a record doesn't have as they were, so
+		// each network needs a fresh one.
+		var rec struct {
+			ASN uint `maxminddb:"autonomous_system_number"`
+		}
+		n, err := nets.Network(&rec)
+		if err != nil {
+			return nil, err
+		}
+
+		if aliasesIPv4(n.IP) {
+			continue
+		}
+
+		if rec.ASN != 0 {
+			counts[rec.ASN]++
+		}
+
+	}
+
+	return counts, nets.Err()
+
+}
+
+func aliasesIPv4(ip net.IP) bool {
+	if len(ip) != net.IPv6len {
+		return false
+	}
+	for _, a := range ipv4Aliases {
+		if a.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Count prefixes, if enabled, in a newly opened ASN database, before it is
+// swapped in.  Nil if disabled, or if counting fails, in which case the
+// previous counts are kept.  Doesn't need the lock.
+func (s *work) prefixCounts(r *maxminddb.Reader) map[uint]int {
+
+	if !s.asnPrefixCount || r == nil {
+		return nil
+	}
+
+	start := time.Now()
+	counts, err := countASNPrefixes(r)
+	if err != nil {
+		utils.Log("Couldn't count ASN prefixes: %s", err.Error())
+		return nil
+	}
+
+	utils.Log("Counted prefixes for %d ASNs in %s.", len(counts),
+		time.Since(start))
+	return counts
+
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"testing"
+)
+
+// A network without an ASN isn't counted against the one before it.
+func TestCountASNPrefixes(t *testing.T) {
+
+	dir, cleanup := testDir(t)
+	defer cleanup()
+
+	path := testDB(t, dir, "asn.mmdb", "GeoLite2-ASN", 1, []testNetwork{
+		{"1.2.3.0/24", testASNRecord(64500, "Example Net")},
+		{"1.2.4.0/24", testASNRecord(64500, "Example Net")},
+		{"5.6.7.0/24", map[string]interface{}{
+			"autonomous_system_organization": "No Number",
+		}},
+		{"2001:4860::/32", testASNRecord(15169, "Google LLC")},
+		{"::ffff:1.2.5.0/120", testASNRecord(64501, "Aliased")},
+	})
+
+	db, err := openDatabase(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.close()
+
+	counts, err := countASNPrefixes(db.raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[uint]int{64500: 2, 15169: 1}
+	if len(counts) != len(want) {
+		t.Errorf("counts %v, expected %v", counts, want)
+	}
+	for asn, n := range want {
+		if counts[asn] != n {
+			t.Errorf("AS%d: %d prefixes, expected %d", asn, counts[asn], n)
+		}
+	}
+
+}
+
+// Counts follow a reloaded ASN database.
+func TestPrefixCountsReload(t *testing.T) {
+
+	dir, cleanup := testDir(t)
+	defer cleanup()
+
+	env := testDBEnv(t, dir)
+	env["GEOIP_ASN_PREFIX_COUNT"] = "true"
+	s, closeDBs := testWork(t, env)
+	defer closeDBs()
+
+	if s.asnPrefixes[64500] != 1 {
+		t.Fatalf("counts %v before reload", s.asnPrefixes)
+	}
+
+	testDB(t, dir, "asn.mmdb", "GeoLite2-ASN", 2, []testNetwork{
+		{"1.2.3.0/24", testASNRecord(64500, "Example Net")},
+		{"1.2.4.0/24", testASNRecord(64500, "Example Net")},
+		{"1.2.5.0/24", testASNRecord(64500, "Example Net")},
+	})
+	s.reloadGeoIP()
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if s.asnPrefixes[64500] != 3 || s.asnPrefixes[15169] != 0 {
+		t.Errorf("counts %v after reload", s.asnPrefixes)
+	}
+	locn, err := s.lookup("1.2.3.4", s.defaultProfile)
+	if err != nil || locn.ASNPrefixCount != 3 {
+		t.Errorf("lookup after reload: %+v, %v", locn, err)
+	}
+
+}
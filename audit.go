@@ -0,0 +1,201 @@
+//
+// Audit log of enrichment decisions, for diagnosing events which didn't get
+// the location expected.  With GEOIP_AUDIT set, a JSON "audit:" log line per
+// event records the addresses extracted and skipped, and why, the cache
+// outcome of each lookup or why it was skipped (not routable, denylisted,
+// overridden or an excluded ASN), and the resulting location.  GEOIP_AUDIT_RATE
+// samples events (default all) and GEOIP_AUDIT_MAX_PER_SECOND (default 10)
+// caps the lines logged.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+// An address which wasn't looked up.
+type auditSkip struct {
+	Addr   string `json:"addr"`
+	Reason string `json:"reason"`
+}
+
+// Decisions for one direction.
+type auditDirection struct {
+	Addr    string      `json:"addr,omitempty"`
+	Lookup  string      `json:"lookup,omitempty"`
+	Skipped []auditSkip `json:"skipped,omitempty"`
+}
+
+// Audit record for an event.
+type auditRecord struct {
+	Id       string         `json:"id,omitempty"`
+	Device   string         `json:"device,omitempty"`
+	Src      auditDirection `json:"src"`
+	Dest     auditDirection `json:"dest"`
+	Location *locationInfo  `json:"location"`
+}
+
+// Audit settings, and the rate limit's current second and count.
+type auditLog struct {
+	rate   float64
+	max    int
+	lock   sync.Mutex
+	second time.Time
+	count  int
+}
+
+// Whether to audit this event.
+func (a *auditLog) sample() bool {
+
+	if a.rate < 1.0 && rand.Float64() >= a.rate {
+		return false
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	now := time.Now().Truncate(time.Second)
+	if !now.Equal(a.second) {
+		a.second = now
+		a.count = 0
+	}
+	if a.count >= a.max {
+		return false
+	}
+	a.count++
+	return true
+
+}
+
+// Start an audit record with the address decisions.
+func (s *work) startAudit(ev *event, src, dest string) *auditRecord {
+	return &auditRecord{
+		Id:     ev.Id,
+		Device: ev.Device,
+		Src:    s.auditDirection(ev.Src, src, s.srcFamilyPref),
+		Dest:   s.auditDirection(ev.Dest, dest, s.destFamilyPref),
+	}
+}
+
+// Decisions for one direction's address list, scanned as extractAddr does.
+func (s *work) auditDirection(addrs []string, chosen,
+	pref string) auditDirection {
+
+	d := auditDirection{Addr: chosen}
+
+	scanned := scannedAddrs(addrs)
+	for _, v := range scanned {
+
+		addr, family := parseAddr(v)
+		switch {
+		case addr == "":
+			d.Skipped = append(d.Skipped, auditSkip{v, "not an IP address"})
+		case addr == chosen:
+		case pref == "first":
+			d.Skipped = append(d.Skipped, auditSkip{v, "not the first"})
+		default:
+			d.Skipped = append(d.Skipped, auditSkip{v,
+				family + " address, preference is " + pref})
+		}
+
+	}
+	for _, v := range addrs[len(scanned):] {
+		d.Skipped = append(d.Skipped, auditSkip{v, "beyond GEOIP_MAX_ADDRS"})
+	}
+
+	if chosen == "" {
+		d.Lookup = "no address"
+		return d
+	}
+
+	// In the order lookup checks them.
+	ip := net.ParseIP(chosen)
+	switch {
+	case s.denied(ip):
+		d.Lookup = "skipped, denylisted"
+	case s.overrides.lookup(ip) != nil:
+		d.Lookup = "overridden"
+	case nonRoutable(ip, !s.lookupCGNAT):
+		d.Lookup = "skipped, not routable"
+	}
+
+	return d
+
+}
+
+// ASN of an address, if it's one lookups exclude, otherwise 0.  Lookups
+// check the ASN whatever the profile.
+func (s *work) excludedASN(addr string) uint {
+
+	if len(s.excludeASN) == 0 {
+		return 0
+	}
+	ip := net.ParseIP(addr)
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	var asn uint
+	switch {
+	case s.enterprise && s.cityDB.loaded():
+		ent, err := s.cityDB.reader.Enterprise(ip)
+		if err == nil && ent != nil {
+			asn = ent.Traits.AutonomousSystemNumber
+		}
+	case s.asnDB.loaded():
+		rec, err := s.asnDB.reader.ASN(ip)
+		if err == nil && rec != nil {
+			asn = rec.AutonomousSystemNumber
+		}
+	}
+
+	if !s.excludeASN[asn] {
+		return 0
+	}
+	return asn
+
+}
+
+// Log a finished audit record, with the lookup results and where they came
+// from.
+func (s *work) logAudit(rec *auditRecord, loc *locationInfo,
+	sources lookupSources) {
+
+	var src, dest *place
+	if loc != nil {
+		src, dest = loc.Src, loc.Dest
+	}
+	for _, d := range []struct {
+		dir    *auditDirection
+		p      *place
+		source string
+	}{{&rec.Src, src, sources.Src}, {&rec.Dest, dest, sources.Dest}} {
+		if d.dir.Lookup != "" {
+			continue
+		}
+		d.dir.Lookup = d.source
+		if d.p != nil {
+			continue
+		}
+		if asn := s.excludedASN(d.dir.Addr); asn != 0 {
+			d.dir.Lookup = fmt.Sprintf("skipped, excluded ASN %d", asn)
+		}
+	}
+
+	rec.Location = loc
+	j, err := json.Marshal(rec)
+	if err != nil {
+		s.errLog.log("Audit marshal error: %s", err.Error())
+		return
+	}
+	utils.Log("audit: %s", string(j))
+
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// Audit records skip the entries extraction skips, and say why a lookup was
+// skipped: denylisted, overridden, or an excluded ASN.
+func TestAuditDecisions(t *testing.T) {
+
+	oldMax := maxAddrs
+	defer func() { maxAddrs = oldMax }()
+
+	dir, cleanup := testDir(t)
+	defer cleanup()
+
+	overrides := filepath.Join(dir, "overrides.json")
+	err := ioutil.WriteFile(overrides,
+		[]byte(`{"1.2.5.0/24": {"city": "Paris", "iso": "FR"}}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, closeDBs := testWork(t, map[string]string{
+		"GEOIP_DB": testDB(t, dir, "city.mmdb", "GeoLite2-City", 1,
+			[]testNetwork{
+				{"1.2.3.0/24",
+					testCityRecord("GB", "United Kingdom", "London")},
+				{"1.2.4.0/24", testCityRecord("US", "United States", "")},
+			}),
+		"GEOIP_ASN_DB": testDB(t, dir, "asn.mmdb", "GeoLite2-ASN", 1,
+			[]testNetwork{
+				{"1.2.3.0/24", testASNRecord(64500, "Example Net")},
+				{"1.2.4.0/24", testASNRecord(64501, "Excluded Net")},
+			}),
+		"GEOIP_MAX_ADDRS":   "2",
+		"GEOIP_DENY_CIDRS":  "1.2.6.0/24",
+		"GEOIP_EXCLUDE_ASN": "AS64501",
+		"GEOIP_OVERRIDES":   overrides,
+	})
+	defer closeDBs()
+
+	// Past the limit, an address isn't a candidate, even of the preferred
+	// family.
+	d := s.auditDirection(
+		[]string{"ipv4:1.2.3.4", "mac:00:11", "ipv6:2001:db8::1"},
+		"1.2.3.4", "v6")
+	expected := []auditSkip{
+		{"mac:00:11", "not an IP address"},
+		{"ipv6:2001:db8::1", "beyond GEOIP_MAX_ADDRS"},
+	}
+	if !reflect.DeepEqual(d.Skipped, expected) {
+		t.Errorf("skipped %+v", d.Skipped)
+	}
+	if d.Addr != extractAddr([]string{"ipv4:1.2.3.4", "mac:00:11",
+		"ipv6:2001:db8::1"}, "v6") {
+		t.Errorf("audit chose %s, unlike extraction", d.Addr)
+	}
+
+	for _, c := range []struct {
+		addr   string
+		lookup string
+	}{
+		{"1.2.3.4", "database"},
+		{"1.2.4.4", "skipped, excluded ASN 64501"},
+		{"1.2.5.4", "overridden"},
+		{"1.2.6.4", "skipped, denylisted"},
+		{"10.0.0.1", "skipped, not routable"},
+	} {
+		ev := &event{}
+		ev.Src = addrList{"ipv4:" + c.addr}
+		rec := s.startAudit(ev, c.addr, "")
+		loc, sources := s.locateLocked(c.addr, "", s.defaultProfile)
+		s.logAudit(rec, loc, sources)
+		if rec.Src.Lookup != c.lookup {
+			t.Errorf("%s: lookup %q, expected %q", c.addr, rec.Src.Lookup,
+				c.lookup)
+		}
+	}
+
+}
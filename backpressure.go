@@ -0,0 +1,98 @@
+//
+// Downstream backpressure.  With GEOIP_BACKPRESSURE_THRESHOLD set, output
+// sends are timed, and backpressure mode engages when the smoothed send time
+// goes over the threshold, and disengages when it falls under half of it.
+// In backpressure mode, GEOIP_BACKPRESSURE_ACTION "shed" (the default)
+// passes events through un-enriched, and "slow" holds each event back by the
+// smoothed send time before handling it.
+//
+
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+// Events passed through un-enriched under backpressure.
+var shedEvents = expvar.NewInt("geoip_shed_events")
+
+type backpressure struct {
+	lock sync.Mutex
+
+	// Smoothed send time which engages backpressure mode.
+	threshold time.Duration
+
+	// Shed enrichment, rather than slowing intake.
+	shed bool
+
+	// Smoothed send time.
+	avg time.Duration
+
+	engaged bool
+}
+
+func newBackpressure(threshold time.Duration, action string) (*backpressure,
+	error) {
+
+	b := &backpressure{threshold: threshold}
+	switch action {
+	case "shed":
+		b.shed = true
+	case "slow":
+	default:
+		return nil, fmt.Errorf("GEOIP_BACKPRESSURE_ACTION: unknown action: %s",
+			action)
+	}
+	return b, nil
+
+}
+
+// Record how long a send took.
+func (b *backpressure) observe(d time.Duration) {
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	// Smooth over the last several sends, so one slow send doesn't count.
+	b.avg += (d - b.avg) / 8
+
+	switch {
+	case !b.engaged && b.avg > b.threshold:
+		b.engaged = true
+		if b.shed {
+			utils.Log("Output backed up (send time %s), passing events "+
+				"through un-enriched", b.avg)
+		} else {
+			utils.Log("Output backed up (send time %s), slowing intake",
+				b.avg)
+		}
+	case b.engaged && b.avg < b.threshold/2:
+		b.engaged = false
+		utils.Log("Output recovered (send time %s), backpressure mode off",
+			b.avg)
+	}
+
+}
+
+// Whether to shed enrichment for the next event, and how long to hold it
+// back.  Both zero values when backpressure mode is off.
+func (b *backpressure) state() (bool, time.Duration) {
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	switch {
+	case !b.engaged:
+		return false, 0
+	case b.shed:
+		return true, 0
+	default:
+		return false, b.avg
+	}
+
+}
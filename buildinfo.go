@@ -0,0 +1,75 @@
+//
+// Build version and a summary of the running configuration, logged at
+// startup for support triage.
+//
+
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Worker version, set at build time with -ldflags "-X main.version=...".
+var version = "unknown"
+
+// Remove credentials from a URL for logging.
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil {
+		return "(unparseable)"
+	}
+	if u.User != nil {
+		u.User = url.User("redacted")
+	}
+	if u.RawQuery != "" {
+		u.RawQuery = "redacted"
+	}
+	return u.String()
+}
+
+// One-line summary of the configuration.
+func (s *work) describe() string {
+
+	var parts []string
+	add := func(format string, args ...interface{}) {
+		parts = append(parts, fmt.Sprintf(format, args...))
+	}
+
+	add("version=%s", version)
+
+	for _, d := range append(s.requiredDBs(), s.optionalDBs()...) {
+		add("%s=%s", strings.ToLower(d.name), d.filename)
+		if d.remote != nil {
+			add("%s_url=%s", strings.ToLower(d.name),
+				redactURL(d.remote.url))
+		}
+	}
+
+	add("country_only=%t", s.countryOnly)
+	add("locales=%s", strings.Join(s.locales, ","))
+
+	if s.cache != nil {
+		add("cache_size=%d", s.cache.size)
+	} else {
+		add("cache_size=0")
+	}
+	if s.flowCache != nil {
+		add("flow_cache_size=%d", s.flowCache.size)
+	}
+
+	add("update_period=%s", updatePeriod)
+	add("update_timeout=%s", updateTimeout)
+	add("output=%s", s.outputFormat)
+	add("sample_rate=%g", s.sampleRate)
+	if s.httpAddr != "" {
+		add("http=%s", s.httpAddr)
+	}
+	if s.tracer != nil {
+		add("otlp=%s", redactURL(s.tracer.endpoint))
+	}
+
+	return strings.Join(parts, " ")
+
+}
@@ -0,0 +1,174 @@
+//
+// Bounded LRU cache, with optional expiry of entries after a fixed time.
+//
+
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+type lruEntry struct {
+	key   string
+	value interface{}
+	added time.Time
+}
+
+type lru struct {
+	lock sync.Mutex
+
+	// Maximum entries, and maximum entry age (0 for no expiry).
+	size int
+	ttl  time.Duration
+
+	items map[string]*list.Element
+	order *list.List
+
+	// Running totals.
+	hits      int64
+	misses    int64
+	evictions int64
+}
+
+// Cache effectiveness figures.
+type lruStats struct {
+	Size      int     `json:"size"`
+	Hits      int64   `json:"hits"`
+	Misses    int64   `json:"misses"`
+	Evictions int64   `json:"evictions"`
+	HitRate   float64 `json:"hit_rate"`
+}
+
+func newLRU(size int, ttl time.Duration) *lru {
+	return &lru{
+		size:  size,
+		ttl:   ttl,
+		items: map[string]*list.Element{},
+		order: list.New(),
+	}
+}
+
+// Fetch an entry, marking it most recently used.
+func (c *lru) get(key string) (interface{}, bool) {
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	elt, ok := c.items[key]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+
+	ent := elt.Value.(*lruEntry)
+	if c.ttl > 0 && time.Since(ent.added) > c.ttl {
+		c.order.Remove(elt)
+		delete(c.items, key)
+		c.misses++
+		return nil, false
+	}
+
+	c.order.MoveToFront(elt)
+	c.hits++
+	return ent.value, true
+
+}
+
+// Store an entry, evicting the least recently used if full.
+func (c *lru) put(key string, value interface{}) {
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if elt, ok := c.items[key]; ok {
+		ent := elt.Value.(*lruEntry)
+		ent.value = value
+		ent.added = time.Now()
+		c.order.MoveToFront(elt)
+		return
+	}
+
+	c.items[key] = c.order.PushFront(&lruEntry{key, value, time.Now()})
+
+	for c.order.Len() > c.size {
+		elt := c.order.Back()
+		c.order.Remove(elt)
+		delete(c.items, elt.Value.(*lruEntry).key)
+		c.evictions++
+	}
+
+}
+
+// Snapshot of the entries, most recently used first.  Expired entries are
+// left out.
+func (c *lru) entries() []lruEntry {
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	ents := make([]lruEntry, 0, c.order.Len())
+	for elt := c.order.Front(); elt != nil; elt = elt.Next() {
+		ent := elt.Value.(*lruEntry)
+		if c.ttl > 0 && time.Since(ent.added) > c.ttl {
+			continue
+		}
+		ents = append(ents, *ent)
+	}
+
+	return ents
+
+}
+
+// Number of entries.
+func (c *lru) len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.order.Len()
+}
+
+// Current size and running totals.
+func (c *lru) stats() lruStats {
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	st := lruStats{
+		Size:      c.order.Len(),
+		Hits:      c.hits,
+		Misses:    c.misses,
+		Evictions: c.evictions,
+	}
+	if c.hits+c.misses > 0 {
+		st.HitRate = float64(c.hits) / float64(c.hits+c.misses)
+	}
+
+	return st
+
+}
+
+// Remove all entries.
+func (c *lru) purge() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.items = map[string]*list.Element{}
+	c.order.Init()
+}
+
+// Change the maximum entries, evicting the least recently used to fit.  0
+// holds nothing.
+func (c *lru) resize(size int) {
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.size = size
+	for c.order.Len() > c.size {
+		elt := c.order.Back()
+		c.order.Remove(elt)
+		delete(c.items, elt.Value.(*lruEntry).key)
+		c.evictions++
+	}
+
+}
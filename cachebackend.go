@@ -0,0 +1,293 @@
+//
+// Address cache backends.  The in-process LRU is the default.  With
+// GEOIP_CACHE_REDIS set to a Redis address (host:port), a Redis server is
+// used instead, so that a fleet of workers shares one warm cache.
+//
+// Redis keys include the build epochs of the databases (0 for one which
+// isn't open), so entries from an older database are never used, and a
+// digest of the settings which shape locations, so workers configured
+// differently don't share them.  The digest covers the runtime settings
+// (locales, precision, alpha-3 codes, subdivision level, output keys and
+// the like) and the startup ones: database type, ASN names and countries,
+// RIR data, anycast, NAT64, denied and excluded ranges, overrides and
+// centroids, including the contents of the files they name.
+//
+// Redis is read before a lookup takes the database lock, and written after
+// it's released, so a slow server doesn't hold up database reloads.
+// Entries expire after GEOIP_CACHE_REDIS_TTL (default a day, the update
+// period).  Redis errors are logged, and treated as misses.
+//
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// Address cache.  A nil place records an address known to have no
+// location.
+type addrCache interface {
+	get(key string) (*place, bool)
+	put(key string, p *place)
+}
+
+// The in-process LRU as an address cache.
+type localCache struct {
+	c *lru
+}
+
+func (l localCache) get(key string) (*place, bool) {
+	v, ok := l.c.get(key)
+	if !ok {
+		return nil, false
+	}
+	return v.(*place), true
+}
+
+func (l localCache) put(key string, p *place) {
+	l.c.put(key, p)
+}
+
+// Redis address cache.  Lookups use it through a batch for each pass.
+type redisCache struct {
+	pool *redis.Pool
+	ttl  time.Duration
+	s    *work
+
+	// Digest of the startup settings, and of them with the runtime ones.
+	startup string
+	digest  string
+}
+
+func newRedisCache(addr string, ttl time.Duration, s *work) *redisCache {
+	r := &redisCache{
+		pool: &redis.Pool{
+			MaxIdle:     8,
+			IdleTimeout: 5 * time.Minute,
+			Dial: func() (redis.Conn, error) {
+				return redis.Dial("tcp", addr,
+					redis.DialConnectTimeout(time.Second),
+					redis.DialReadTimeout(time.Second),
+					redis.DialWriteTimeout(time.Second))
+			},
+		},
+		ttl:     ttl,
+		s:       s,
+		startup: startupDigest(),
+	}
+	r.digest = r.s.placeDigest(r.startup)
+	return r
+}
+
+// Startup settings which shape looked-up places, and whether each names
+// files, comma-separated, whose contents count too.
+var placeSettings = []struct {
+	name  string
+	files bool
+}{
+	{"GEOIP_DB_TYPE", false},
+	{"GEOIP_COUNTRY_SOURCE", false},
+	{"GEOIP_ASN_NAMES_FILE", true},
+	{"GEOIP_ASN_COUNTRY_FILE", true},
+	{"GEOIP_COUNTRY_ASN_MISMATCH", false},
+	{"GEOIP_ASN_PREFIX_COUNT", false},
+	{"GEOIP_RIR", false},
+	{"GEOIP_RIR_FILES", true},
+	{"GEOIP_LOOKUP_CGNAT", false},
+	{"GEOIP_NAT64_PREFIXES", false},
+	{"GEOIP_DENY_CIDRS", false},
+	{"GEOIP_ANYCAST_CIDRS", false},
+	{"GEOIP_ANYCAST_SUPPRESS_POSITION", false},
+	{"GEOIP_EXCLUDE_ASN", false},
+	{"GEOIP_OVERRIDES", true},
+	{"GEOIP_COUNTRY_CENTROIDS", false},
+	{"GEOIP_CENTROID_FILE", true},
+}
+
+// Digest of the startup settings.  These are fixed once loaded, so the
+// files are read once, at startup, as they were loaded.
+func startupDigest() string {
+
+	h := sha256.New()
+	for _, v := range placeSettings {
+
+		val := os.Getenv(v.name)
+		fmt.Fprintf(h, "%s=%q\n", v.name, val)
+		if !v.files || val == "" {
+			continue
+		}
+
+		// A file which can't be read now was read at loading, and just
+		// its name counts.
+		for _, file := range strings.Split(val, ",") {
+			if data, err := ioutil.ReadFile(file); err == nil {
+				sum := sha256.Sum256(data)
+				fmt.Fprintf(h, "%s:%x\n", file, sum)
+			}
+		}
+
+	}
+	return hex.EncodeToString(h.Sum(nil))
+
+}
+
+// Digest of the settings which shape looked-up places: the runtime ones,
+// under a startup digest.  Called with the database lock held, or before
+// lookups start.
+func (s *work) placeDigest(startup string) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf(
+		"%s|%q|%v|%v|%d|%v|%v|%v|%v|%v|%v|%d|%v|%v", startup, s.locales,
+		s.countryMetadata, s.precision, s.exactRadiusKm, s.geoNameIDs,
+		s.flagEmoji, s.alpha3, s.staticIPScore, s.timeZone,
+		s.registeredCountry, s.subdivisionLevel, s.centroids != nil,
+		keyRemap)))
+	return hex.EncodeToString(sum[:4])
+}
+
+// Build epoch of a database, 0 if it isn't open.
+func epoch(d *database) uint {
+	if !d.loaded() {
+		return 0
+	}
+	return d.reader.Metadata().BuildEpoch
+}
+
+// Redis key for a cache key, under the open databases and the current
+// settings.  Called with the database lock held.
+func (r *redisCache) key(key string) string {
+	return fmt.Sprintf("geoip:%d:%d:%d:%d:%s:%s", epoch(r.s.cityDB),
+		epoch(r.s.asnDB), epoch(r.s.ispDB), epoch(r.s.anonDB), r.digest,
+		key)
+}
+
+// Redis entries for one pass of lookups, as an address cache.  Entries are
+// fetched before the pass, and new ones kept to be stored after it.
+type redisBatch struct {
+	r       *redisCache
+	entries map[string]*place
+	pending []redisEntry
+}
+
+type redisEntry struct {
+	key  string
+	data []byte
+}
+
+// Fetch entries for cache keys into a batch.  Called without the database
+// lock held, which is taken just to make the Redis keys.
+func (r *redisCache) fetch(keys []string) *redisBatch {
+
+	b := &redisBatch{r: r, entries: map[string]*place{}}
+	if len(keys) == 0 {
+		return b
+	}
+
+	args := make([]interface{}, len(keys))
+	r.s.lock.RLock()
+	for i, k := range keys {
+		args[i] = r.key(k)
+	}
+	r.s.lock.RUnlock()
+
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	vals, err := redis.ByteSlices(conn.Do("MGET", args...))
+	if err != nil {
+		r.s.errLog.log("Redis cache error: %s", err.Error())
+		return b
+	}
+
+	for i, data := range vals {
+
+		// Not cached.
+		if data == nil {
+			continue
+		}
+
+		// Native keys, whatever the output key style.
+		var p *placeFields
+		err = json.Unmarshal(data, &p)
+		if err != nil {
+			r.s.errLog.log("Redis cache entry error: %s", err.Error())
+			continue
+		}
+		b.entries[args[i].(string)] = (*place)(p)
+
+	}
+	return b
+
+}
+
+// Called with the database lock held, so the Redis key matches the open
+// databases.  An entry fetched under other databases is a miss.
+func (b *redisBatch) get(key string) (*place, bool) {
+	p, ok := b.entries[b.r.key(key)]
+	return p, ok
+}
+
+func (b *redisBatch) put(key string, p *place) {
+
+	data, err := json.Marshal((*placeFields)(p))
+	if err != nil {
+		b.r.s.errLog.log("Redis cache entry error: %s", err.Error())
+		return
+	}
+
+	k := b.r.key(key)
+	b.entries[k] = p
+	b.pending = append(b.pending, redisEntry{k, data})
+
+}
+
+// Store the entries put in the batch.  Called without the database lock
+// held.
+func (b *redisBatch) flush() {
+
+	if len(b.pending) == 0 {
+		return
+	}
+
+	conn := b.r.pool.Get()
+	defer conn.Close()
+
+	for _, e := range b.pending {
+		_, err := conn.Do("SET", e.key, e.data, "EX",
+			int(b.r.ttl/time.Second))
+		if err != nil {
+			b.r.s.errLog.log("Redis cache error: %s", err.Error())
+			return
+		}
+	}
+	b.pending = nil
+
+}
+
+// Address cache for a pass of lookups of some addresses, and a function to
+// call after it.  Called without the database lock held, so that Redis
+// round trips happen outside it.
+func (s *work) passCache(p profile, addrs ...string) (addrCache, func()) {
+
+	if s.redisCache == nil {
+		return s.addrCache, func() {}
+	}
+
+	var keys []string
+	for _, a := range addrs {
+		if a != "" {
+			keys = append(keys, p.key(a))
+		}
+	}
+	b := s.redisCache.fetch(keys)
+	return b, b.flush
+
+}
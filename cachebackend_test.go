@@ -0,0 +1,108 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// Redis keys differ between settings which shape places, and not otherwise.
+func TestRedisKeySettings(t *testing.T) {
+
+	base := func() *work {
+		return &work{locales: []string{"en"}, subdivisionLevel: -1}
+	}
+	key := func(s *work) string {
+		return newRedisCache("localhost:0", 0, s).key("1.2.3.4")
+	}
+
+	plain := key(base())
+	same := base()
+	same.sampleRate = 0.5
+	if key(same) != plain {
+		t.Errorf("sample rate changed the key")
+	}
+
+	for name, change := range map[string]func(s *work){
+		"locales":           func(s *work) { s.locales = []string{"fr"} },
+		"precision":         func(s *work) { s.precision = true },
+		"alpha-3":           func(s *work) { s.alpha3 = true },
+		"subdivision level": func(s *work) { s.subdivisionLevel = 0 },
+		"key remap": func(s *work) {
+			keyRemap = map[string]string{"iso": "iso_code"}
+		},
+	} {
+		s := base()
+		change(s)
+		if key(s) == plain {
+			t.Errorf("%s didn't change the key", name)
+		}
+		keyRemap = nil
+	}
+
+}
+
+// Redis keys differ between startup settings which shape places, and the
+// contents of the files they name.
+func TestRedisKeyStartupSettings(t *testing.T) {
+
+	dir, cleanup := testDir(t)
+	defer cleanup()
+
+	overrides := filepath.Join(dir, "overrides.csv")
+	write := func(data string) {
+		err := ioutil.WriteFile(overrides, []byte(data), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	key := func(env map[string]string) string {
+		defer setTestEnv(env)()
+		s := &work{locales: []string{"en"}, subdivisionLevel: -1}
+		return newRedisCache("localhost:0", 0, s).key("1.2.3.4")
+	}
+
+	write("10.0.0.0/8,GB,London\n")
+	plain := key(map[string]string{"GEOIP_OVERRIDES": overrides})
+
+	for name, env := range map[string]map[string]string{
+		"excluded ASNs": {"GEOIP_EXCLUDE_ASN": "64500"},
+		"database type": {"GEOIP_DB_TYPE": "country"},
+		"anycast":       {"GEOIP_ANYCAST_CIDRS": "192.0.2.0/24"},
+		"RIR":           {"GEOIP_RIR": "true"},
+	} {
+		env["GEOIP_OVERRIDES"] = overrides
+		if key(env) == plain {
+			t.Errorf("%s didn't change the key", name)
+		}
+	}
+
+	write("10.0.0.0/8,FR,Paris\n")
+	if key(map[string]string{"GEOIP_OVERRIDES": overrides}) == plain {
+		t.Errorf("overrides file contents didn't change the key")
+	}
+
+}
+
+// Redis keys include the epochs of the optional databases.
+func TestRedisKeyOptionalEpochs(t *testing.T) {
+
+	dir, cleanup := testDir(t)
+	defer cleanup()
+
+	s := &work{locales: []string{"en"}, subdivisionLevel: -1}
+	r := newRedisCache("localhost:0", 0, s)
+	plain := r.key("1.2.3.4")
+
+	s.ispDB = newDatabase("ISP",
+		testDB(t, dir, "isp.mmdb", "GeoIP2-ISP", 7, nil), nil)
+	s.ispDB.edition = "ISP"
+	s.ispDB.open(&sync.Mutex{})
+	defer s.ispDB.close()
+
+	if r.key("1.2.3.4") == plain {
+		t.Errorf("ISP database epoch didn't change the key")
+	}
+
+}
@@ -0,0 +1,128 @@
+//
+// Persistence for the address cache.  With GEOIP_CACHE_FILE set, the cache
+// is loaded at startup and written back periodically
+// (GEOIP_CACHE_FLUSH_INTERVAL, default 5m), so a restart doesn't start cold.
+// The file records the build epochs of the databases the entries came from;
+// if either database has been updated since, the file is ignored.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+// Place without the key-remapping serialiser, so the cache file always
+// uses the native keys.
+type placeFields place
+
+type cacheFileEntry struct {
+	Addr  string       `json:"addr"`
+	Place *placeFields `json:"place"`
+}
+
+type cacheFile struct {
+	CityEpoch uint             `json:"city_epoch"`
+	ASNEpoch  uint             `json:"asn_epoch"`
+	Entries   []cacheFileEntry `json:"entries"`
+}
+
+// Build epochs of the open databases.
+func (s *work) epochs() (uint, uint) {
+	var asnEpoch uint
+	if s.asnDB.loaded() {
+		asnEpoch = s.asnDB.reader.Metadata().BuildEpoch
+	}
+	return s.cityDB.reader.Metadata().BuildEpoch, asnEpoch
+}
+
+// Load the cache file, if it matches the open databases.
+func (s *work) loadCache() {
+
+	f, err := os.Open(s.cacheFile)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		utils.Log("Couldn't open cache file: %s", err.Error())
+		return
+	}
+	defer f.Close()
+
+	var cf cacheFile
+	err = json.NewDecoder(f).Decode(&cf)
+	if err != nil {
+		utils.Log("Couldn't read cache file: %s", err.Error())
+		return
+	}
+
+	city, asn := s.epochs()
+	if cf.CityEpoch != city || cf.ASNEpoch != asn {
+		utils.Log("Cache file is from older databases, ignoring it.")
+		return
+	}
+
+	// Oldest first, so the most recently used end up at the front.
+	for i := len(cf.Entries) - 1; i >= 0; i-- {
+		ent := cf.Entries[i]
+		s.cache.put(ent.Addr, (*place)(ent.Place))
+	}
+
+	utils.Log("Loaded %d cache entries.", len(cf.Entries))
+
+}
+
+// Write the cache file.
+func (s *work) saveCache() error {
+
+	// Entries must match the epochs recorded with them.
+	s.lock.RLock()
+	if !s.ready() {
+		s.lock.RUnlock()
+		return nil
+	}
+	cf := cacheFile{}
+	cf.CityEpoch, cf.ASNEpoch = s.epochs()
+	for _, ent := range s.cache.entries() {
+		cf.Entries = append(cf.Entries, cacheFileEntry{
+			Addr:  ent.key,
+			Place: (*placeFields)(ent.value.(*place)),
+		})
+	}
+	s.lock.RUnlock()
+
+	// Write to a temporary file, then move into place.
+	tmp := s.cacheFile + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	err = json.NewEncoder(f).Encode(&cf)
+	if err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, s.cacheFile)
+
+}
+
+// Goroutine: periodically write the cache file.
+func (s *work) cacheFlusher(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		err := s.saveCache()
+		if err != nil {
+			utils.Log("Couldn't write cache file: %s", err.Error())
+		}
+	}
+}
@@ -0,0 +1,65 @@
+//
+// Helpers for reading typed configuration from environment variables.
+//
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+// Integer environment variable.
+func getenvInt(env string, def int) (int, error) {
+	v := utils.Getenv(env, "")
+	if v == "" {
+		return def, nil
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("%s: invalid integer: %s", env, v)
+	}
+	return i, nil
+}
+
+// Floating point environment variable.
+func getenvFloat(env string, def float64) (float64, error) {
+	v := utils.Getenv(env, "")
+	if v == "" {
+		return def, nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%s: invalid number: %s", env, v)
+	}
+	return f, nil
+}
+
+// Boolean environment variable, e.g. "true", "false", "1", "0".
+func getenvBool(env string, def bool) (bool, error) {
+	v := utils.Getenv(env, "")
+	if v == "" {
+		return def, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("%s: invalid boolean: %s", env, v)
+	}
+	return b, nil
+}
+
+// Duration environment variable, in Go duration syntax e.g. "90s", "5m".
+func getenvDuration(env string, def time.Duration) (time.Duration, error) {
+	v := utils.Getenv(env, "")
+	if v == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("%s: invalid duration: %s", env, v)
+	}
+	return d, nil
+}
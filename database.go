@@ -0,0 +1,273 @@
+//
+// GeoIP database lifecycle.  Each edition (City, ASN) is opened and reloaded
+// independently, so an update to one file doesn't reopen the others.
+//
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oschwald/geoip2-golang"
+	"github.com/oschwald/maxminddb-golang"
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+// A GeoIP database file and its open readers.
+type database struct {
+
+	// Edition name, for log entries.
+	name string
+
+	filename string
+
+	// Remote source, nil if not configured.
+	remote *remoteDB
+
+	// If set, the database type in the file's metadata must contain this,
+	// e.g. "ISP", to catch the wrong edition being mounted.
+	edition string
+
+	// Options for opening the file.
+	opts []openOption
+
+	// If set, a Country edition is expected to be mounted by mistake for a
+	// City one, so is warned about, and looked up as a Country database.
+	expectCity bool
+
+	// Database type from the open file's metadata, e.g. "GeoLite2-City".
+	dbType string
+
+	// Reader for the typed geoip2 lookups, and a raw reader for generic
+	// decoding.
+	reader *geoip2.Reader
+	raw    *maxminddb.Reader
+
+	// The file mapping the readers share, nil if it's in the heap.
+	mapped []byte
+
+	// Modification time and size of the file, and search tree node count,
+	// when it was opened.
+	mtime     time.Time
+	size      int64
+	nodeCount uint
+
+	// Fraction by which a replacement database may be smaller than the
+	// open one, by file size or node count, before it is refused as
+	// probably truncated or corrupt.  0 disables the check.
+	shrinkTolerance float64
+}
+
+func newDatabase(name, filename string, remote *remoteDB) *database {
+	return &database{name: name, filename: filename, remote: remote}
+}
+
+// Open the database, closing any previous readers.  No errors, but doesn't
+// return until the database is open.  The file is fetched and opened without
+// the lock, which is only held while the readers are swapped.
+func (d *database) open(lock sync.Locker) {
+
+	for {
+
+		// Refresh from remote source, if there is one.
+		d.fetch()
+
+		db, err := d.load()
+
+		// If ok, done.
+		if err == nil {
+			lock.Lock()
+			d.install(db)
+			lock.Unlock()
+			return
+		}
+
+		// Open failed, wait for a while and retry.
+		utils.Log("Couldn't open GeoIP %s database: %s", d.name,
+			err.Error())
+		time.Sleep(time.Second * 10)
+
+		// Loop round to retry.
+
+	}
+
+}
+
+// Open and check the database file, without touching the current readers.
+func (d *database) load() (*openedDB, error) {
+
+	db, err := openDatabase(d.filename,
+		append(d.opts, withEdition(d.edition))...)
+	if err != nil {
+		return nil, err
+	}
+	dbType := db.metadata.DatabaseType
+
+	// Refuse a replacement which has shrunk dramatically.
+	nodeCount := db.metadata.NodeCount
+	if d.reader != nil && d.shrinkTolerance > 0 {
+		if shrunk(d.size, db.size, d.shrinkTolerance) ||
+			shrunk(int64(d.nodeCount), int64(nodeCount),
+				d.shrinkTolerance) {
+			db.close()
+			utils.Log("ALERT: GeoIP %s database shrank from %d bytes/%d "+
+				"nodes to %d bytes/%d nodes, keeping the old one", d.name,
+				d.size, d.nodeCount, db.size, nodeCount)
+			return nil, errors.New("replacement database too small")
+		}
+	}
+
+	if d.expectCity && countryEdition(dbType) {
+		utils.Log("WARNING: GeoIP %s database %s is a %s database, which "+
+			"has no city-level data: city, postcode and coordinates will "+
+			"be empty.  Set GEOIP_DB_TYPE=country if this is intended.",
+			d.name, d.filename, dbType)
+	}
+
+	return db, nil
+
+}
+
+// Replace the current readers with a loaded database.  Call with the lock
+// held for writing.
+func (d *database) install(db *openedDB) {
+	d.close()
+	d.reader = db.reader
+	d.raw = db.raw
+	d.mapped = db.mapped
+	d.dbType = db.metadata.DatabaseType
+	d.mtime = db.mtime
+	d.size = db.size
+	d.nodeCount = db.metadata.NodeCount
+}
+
+// Open an optional database.  Unlike open, this tries once; if the file
+// isn't there yet it is picked up by a later reload.  A file which is there
+// but won't open is an error, returned after logging it.  The lock is held
+// while the readers are swapped.
+func (d *database) openOptional(lock sync.Locker) error {
+
+	d.fetch()
+
+	db, err := d.load()
+	if os.IsNotExist(err) {
+		utils.Log("GeoIP %s database not loaded: %s", d.name, err.Error())
+		return nil
+	}
+	if err != nil {
+		utils.Log("ERROR: GeoIP %s database unusable: %s", d.name,
+			err.Error())
+		return fmt.Errorf("GeoIP %s database: %s", d.name, err.Error())
+	}
+
+	lock.Lock()
+	d.install(db)
+	lock.Unlock()
+
+	return nil
+
+}
+
+// Whether a database type is a Country edition.
+func countryEdition(dbType string) bool {
+	return strings.Contains(dbType, "Country")
+}
+
+// Whether the open database is a Country edition.
+func (d *database) country() bool {
+	return d.loaded() && countryEdition(d.dbType)
+}
+
+// Whether the database is open.
+func (d *database) loaded() bool {
+	return d != nil && d.reader != nil
+}
+
+// Whether a value has fallen by more than the tolerated fraction.
+func shrunk(old, cur int64, tolerance float64) bool {
+	return float64(cur) < float64(old)*(1-tolerance)
+}
+
+// Fetch and open the database again if its file has changed, by
+// modification time or size, since it was opened.  Returns the replacement
+// for install, or nil to keep the current readers.  Doesn't need the lock,
+// as only reloads, which are serialised, change the database.
+func (d *database) update() *openedDB {
+
+	// A socket or descriptor is only read once, but one which hasn't
+	// been read yet is tried again.
+	if streamSource(d.filename) {
+		if d.loaded() {
+			return nil
+		}
+		db, err := d.load()
+		if err != nil {
+			utils.Log("Couldn't open GeoIP %s database: %s", d.name,
+				err.Error())
+			return nil
+		}
+		return db
+	}
+
+	// Refresh from remote source, if there is one.
+	d.fetch()
+
+	info, err := os.Stat(d.filename)
+	if err != nil {
+		utils.Log("Couldn't stat GeoIP %s database: %s", d.name,
+			err.Error())
+		return nil
+	}
+
+	// Unchanged file, e.g. a spurious or repeated notification, so
+	// there's nothing to reopen.
+	if d.loaded() && info.ModTime().Equal(d.mtime) &&
+		info.Size() == d.size {
+		return nil
+	}
+
+	// Keep the current readers if the new file won't open.
+	db, err := d.load()
+	if err != nil {
+		utils.Log("Couldn't reopen GeoIP %s database: %s", d.name,
+			err.Error())
+		return nil
+	}
+
+	return db
+
+}
+
+// Fetch the database from its remote source.  Failure isn't fatal, the
+// local copy is used.
+func (d *database) fetch() {
+
+	if d.remote == nil {
+		return
+	}
+
+	err := d.remote.fetch(d.filename)
+	if err == errNotModified {
+		utils.Log("%s not modified, using local copy", d.remote.url)
+	} else if err == errBreakerOpen {
+		utils.Log("Not fetching %s, using local copy", d.remote.url)
+	} else if err != nil {
+		utils.Log("Couldn't fetch %s: %s", d.remote.url, err.Error())
+	} else {
+		utils.Log("Fetched %s", d.remote.url)
+	}
+
+}
+
+// Close readers.
+func (d *database) close() {
+	closeReaders(d.reader, d.raw, d.mapped)
+	d.reader = nil
+	d.raw = nil
+	d.mapped = nil
+}
@@ -0,0 +1,78 @@
+//
+// Dead-letter handling for events which keep failing.  With
+// GEOIP_DEAD_LETTER_OUTPUT set, a failed event is returned as an error, so
+// the queue can redeliver it, until it has failed GEOIP_MAX_ATTEMPTS times;
+// it is then sent to the dead-letter output with the error attached.
+// Attempts are counted in memory, by message digest, for a bounded number
+// of messages.
+//
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+
+	"github.com/trustnetworks/analytics-common/worker"
+)
+
+// Dead-letter record.
+type deadLetter struct {
+	Error    string          `json:"error"`
+	Attempts int             `json:"attempts"`
+	Event    json.RawMessage `json:"event,omitempty"`
+	Raw      string          `json:"raw,omitempty"`
+}
+
+// Most of a message included in a log entry.
+const maxLoggedMessage = 256
+
+// A message for logging, cut short if it is long.
+func truncate(msg []byte, max int) string {
+	if len(msg) <= max {
+		return string(msg)
+	}
+	return string(msg[:max]) + "..."
+}
+
+// Handle a failed event.  Returns the error to give back to the queue, nil
+// if the event is finished with.
+func (s *work) failed(w *worker.Worker, msg []byte, err error) error {
+
+	s.errLog.log("Event failed: %s", err.Error())
+
+	if s.deadLetterOutput == "" {
+		return nil
+	}
+
+	// Count attempts.
+	sum := sha256.Sum256(msg)
+	key := string(sum[:])
+	attempts := 1
+	if v, ok := s.attempts.get(key); ok {
+		attempts = v.(int) + 1
+	}
+	if attempts < s.maxAttempts {
+		s.attempts.put(key, attempts)
+		return err
+	}
+
+	// Start afresh if it turns up again.
+	s.attempts.put(key, 0)
+
+	// Dead-letter it, as JSON if it is JSON.
+	dl := deadLetter{Error: err.Error(), Attempts: attempts}
+	if json.Valid(msg) {
+		dl.Event = msg
+	} else {
+		dl.Raw = string(msg)
+	}
+	j, err := json.Marshal(&dl)
+	if err != nil {
+		return nil
+	}
+	s.send(w, s.deadLetterOutput, j)
+
+	return nil
+
+}
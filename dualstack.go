@@ -0,0 +1,72 @@
+//
+// Dual-stack endpoints.  When an address list has both an IPv4 and an IPv6
+// address, they can geolocate differently, so both can be attached to the
+// direction's location, as its v4 and v6 sub-objects.
+//
+
+package main
+
+// First address of a family, "v4" or "v6", in an address list, or empty.
+func extractFamily(addrs []string, family string) string {
+	for _, v := range scannedAddrs(addrs) {
+		if addr, f := parseAddr(v); f == family {
+			return addr
+		}
+	}
+	return ""
+}
+
+// Locations of both families of an endpoint, or nils if the address list
+// doesn't have both.
+func (s *work) locateFamilies(addrs []string, p profile) (*place, *place) {
+
+	v4 := extractFamily(addrs, "v4")
+	v6 := extractFamily(addrs, "v6")
+	if v4 == "" || v6 == "" {
+		return nil, nil
+	}
+
+	c, flush := s.passCache(p, v4, v6)
+	defer flush()
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	v4Loc, _ := s.resolve(v4, p, c)
+	v6Loc, _ := s.resolve(v6, p, c)
+	s.shape(v4Loc)
+	s.shape(v6Loc)
+
+	return v4Loc, v6Loc
+
+}
+
+// Copy of a location with per-family locations attached to each dual-stack
+// direction which has a location.  The original may be shared with the
+// flow cache, so isn't modified.
+func (s *work) withFamilies(l *locationInfo, src, dest []string,
+	p profile) *locationInfo {
+
+	c := *l
+	for _, d := range []struct {
+		p     **place
+		addrs []string
+	}{{&c.Src, src}, {&c.Dest, dest}} {
+
+		if *d.p == nil {
+			continue
+		}
+
+		v4, v6 := s.locateFamilies(d.addrs, p)
+		if v4 == nil && v6 == nil {
+			continue
+		}
+
+		cp := **d.p
+		cp.V4, cp.V6 = v4, v6
+		*d.p = &cp
+
+	}
+	return &c
+
+}
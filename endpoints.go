@@ -0,0 +1,85 @@
+//
+// Per-endpoint records, for consumers which model each endpoint on its own.
+// With GEOIP_ENDPOINT_RECORDS "also", each enriched event is followed by a
+// record for each direction with an address; with "only", the records
+// replace the event.  Events with no address go through as they are.
+// Records go to GEOIP_ENDPOINT_OUTPUT, or the event's own output, and aren't
+// wrapped by GEOIP_OUTPUT_FORMAT.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/trustnetworks/analytics-common/utils"
+	"github.com/trustnetworks/analytics-common/worker"
+)
+
+// Location of one endpoint of an event.
+type endpointRecord struct {
+	EventID   string `json:"event_id,omitempty"`
+	Direction string `json:"direction"`
+	Address   string `json:"address"`
+	Action    string `json:"action,omitempty"`
+	Device    string `json:"device,omitempty"`
+	Time      string `json:"time,omitempty"`
+	Location  *place `json:"location,omitempty"`
+}
+
+// Read the endpoint record settings.
+func (s *work) initEndpoints() error {
+
+	switch mode := utils.Getenv("GEOIP_ENDPOINT_RECORDS", "none"); mode {
+	case "none":
+	case "also", "only":
+		s.endpointMode = mode
+	default:
+		return fmt.Errorf("GEOIP_ENDPOINT_RECORDS: unknown mode: %s", mode)
+	}
+	s.endpointOutput = utils.Getenv("GEOIP_ENDPOINT_OUTPUT", "")
+	return nil
+
+}
+
+// Send a record for each endpoint of an event which has an address.
+func (s *work) sendEndpoints(w *worker.Worker, out string, ev *event,
+	src, dest string, loc *locationInfo) {
+
+	if s.endpointOutput != "" {
+		out = s.endpointOutput
+	}
+
+	var srcLoc, destLoc *place
+	if loc != nil {
+		srcLoc, destLoc = loc.Src, loc.Dest
+	}
+
+	for _, ep := range []struct {
+		dir, addr string
+		loc       *place
+	}{{"src", src, srcLoc}, {"dest", dest, destLoc}} {
+
+		if ep.addr == "" {
+			continue
+		}
+
+		j, err := json.Marshal(&endpointRecord{
+			EventID:   ev.Id,
+			Direction: ep.dir,
+			Address:   ep.addr,
+			Action:    ev.Action,
+			Device:    ev.Device,
+			Time:      ev.Time,
+			Location:  ep.loc,
+		})
+		if err != nil {
+			s.errLog.log("Endpoint record marshal error: %s", err.Error())
+			continue
+		}
+		s.send(w, out, j)
+
+	}
+
+}
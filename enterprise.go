@@ -0,0 +1,119 @@
+//
+// GeoIP2 Enterprise databases, with GEOIP_DB_TYPE=enterprise.  One
+// Enterprise record holds the City fields, with confidences, and the ASN,
+// ISP, connection type and user type, so one lookup replaces the City, ASN
+// and ISP database lookups.  The record is converted to the City, Country
+// and ASN forms so that it fills a place the same way they do.
+//
+
+package main
+
+import (
+	"net"
+
+	"github.com/oschwald/geoip2-golang"
+)
+
+// Fill in a place's location fields from the Enterprise database, returning
+// the record for the network fields.  Nil if there's no record.
+func (s *work) lookupEnterprise(ip net.IP, locn *place, p profile) (
+	*geoip2.Enterprise, error) {
+
+	ent, err := s.cityDB.reader.Enterprise(ip)
+	if err != nil {
+		return nil, err
+	}
+
+	// If nil return, nothing to add.
+	if ent == nil {
+		return nil, nil
+	}
+
+	locn.CountryConfidence = ent.Country.Confidence
+	if p&profileCity == 0 {
+		s.fillCountry(locn, enterpriseCountry(ent))
+		return ent, nil
+	}
+
+	err = s.fillCity(ip, locn, enterpriseCity(ent))
+	if err != nil {
+		return nil, err
+	}
+
+	if i := s.subdivisionIndex(len(ent.Subdivisions)); i >= 0 {
+		locn.SubdivisionConfidence = ent.Subdivisions[i].Confidence
+	}
+	locn.CityConfidence = ent.City.Confidence
+	locn.PostCodeConfidence = ent.Postal.Confidence
+
+	return ent, nil
+
+}
+
+// City form of an Enterprise record.
+func enterpriseCity(ent *geoip2.Enterprise) *geoip2.City {
+
+	city := &geoip2.City{}
+	city.City.GeoNameID = ent.City.GeoNameID
+	city.City.Names = ent.City.Names
+	city.Continent = ent.Continent
+	city.Country.GeoNameID = ent.Country.GeoNameID
+	city.Country.IsInEuropeanUnion = ent.Country.IsInEuropeanUnion
+	city.Country.IsoCode = ent.Country.IsoCode
+	city.Country.Names = ent.Country.Names
+	city.Location = ent.Location
+	city.Postal.Code = ent.Postal.Code
+	city.RegisteredCountry.GeoNameID = ent.RegisteredCountry.GeoNameID
+	city.RegisteredCountry.IsInEuropeanUnion =
+		ent.RegisteredCountry.IsInEuropeanUnion
+	city.RegisteredCountry.IsoCode = ent.RegisteredCountry.IsoCode
+	city.RegisteredCountry.Names = ent.RegisteredCountry.Names
+	city.RepresentedCountry = ent.RepresentedCountry
+
+	city.Subdivisions = make([]struct {
+		GeoNameID uint              `maxminddb:"geoname_id"`
+		IsoCode   string            `maxminddb:"iso_code"`
+		Names     map[string]string `maxminddb:"names"`
+	}, len(ent.Subdivisions))
+	for i, sub := range ent.Subdivisions {
+		city.Subdivisions[i].GeoNameID = sub.GeoNameID
+		city.Subdivisions[i].IsoCode = sub.IsoCode
+		city.Subdivisions[i].Names = sub.Names
+	}
+
+	city.Traits.IsAnonymousProxy = ent.Traits.IsAnonymousProxy
+	city.Traits.IsSatelliteProvider = ent.Traits.IsSatelliteProvider
+
+	return city
+
+}
+
+// Country form of an Enterprise record.
+func enterpriseCountry(ent *geoip2.Enterprise) *geoip2.Country {
+
+	country := &geoip2.Country{}
+	country.Continent = ent.Continent
+	country.Country.GeoNameID = ent.Country.GeoNameID
+	country.Country.IsInEuropeanUnion = ent.Country.IsInEuropeanUnion
+	country.Country.IsoCode = ent.Country.IsoCode
+	country.Country.Names = ent.Country.Names
+	country.RegisteredCountry.GeoNameID = ent.RegisteredCountry.GeoNameID
+	country.RegisteredCountry.IsInEuropeanUnion =
+		ent.RegisteredCountry.IsInEuropeanUnion
+	country.RegisteredCountry.IsoCode = ent.RegisteredCountry.IsoCode
+	country.RegisteredCountry.Names = ent.RegisteredCountry.Names
+
+	return country
+
+}
+
+// ASN form of an Enterprise record, or nil if it has no ASN.
+func enterpriseASN(ent *geoip2.Enterprise) *geoip2.ASN {
+	if ent.Traits.AutonomousSystemNumber == 0 {
+		return nil
+	}
+	return &geoip2.ASN{
+		AutonomousSystemNumber:       ent.Traits.AutonomousSystemNumber,
+		AutonomousSystemOrganization: ent.Traits.AutonomousSystemOrganization,
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+)
+
+// An Enterprise record fills in the user type, along with its ASN and ISP,
+// and a City record leaves it out.
+func TestLookupEnterpriseUserType(t *testing.T) {
+
+	dir, cleanup := testDir(t)
+	defer cleanup()
+
+	rec := testCityRecord("GB", "United Kingdom", "London")
+	rec["traits"] = map[string]interface{}{
+		"autonomous_system_number":       uint(64500),
+		"autonomous_system_organization": "Example Net",
+		"isp":                            "Example ISP",
+		"user_type":                      "residential",
+	}
+	s, closeDBs := testWork(t, map[string]string{
+		"GEOIP_DB_TYPE": "enterprise",
+		"GEOIP_DB": testDB(t, dir, "enterprise.mmdb", "GeoIP2-Enterprise",
+			1, []testNetwork{{"1.2.3.0/24", rec}}),
+	})
+	defer closeDBs()
+
+	s.lock.RLock()
+	locn, err := s.lookup("1.2.3.4", fullProfile)
+	s.lock.RUnlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if locn.UserType != "residential" {
+		t.Errorf("user type %q, expected residential", locn.UserType)
+	}
+	if locn.ASNum != 64500 || locn.ISP != "Example ISP" {
+		t.Errorf("ASN %d, ISP %q", locn.ASNum, locn.ISP)
+	}
+
+	// City databases don't carry it.
+	c, closeCity := testWork(t, testDBEnv(t, dir))
+	defer closeCity()
+
+	c.lock.RLock()
+	locn, err = c.lookup("1.2.3.4", fullProfile)
+	c.lock.RUnlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if locn.UserType != "" {
+		t.Errorf("City database gave user type %q", locn.UserType)
+	}
+
+}
@@ -0,0 +1,59 @@
+//
+// Lookup errors.  lookup returns one of these kinds, so that callers can tell
+// a bad address from a miss from a database problem.
+//
+
+package main
+
+import (
+	"errors"
+)
+
+var (
+
+	// The address isn't an IP address.
+	ErrInvalidIP = errors.New("invalid IP address")
+
+	// The databases hold no location for the address.
+	ErrNotFound = errors.New("address not found")
+
+	// A database lookup failed.
+	ErrDatabase = errors.New("database error")
+)
+
+// Cause of ErrDatabase when a database isn't open, e.g. while it is being
+// reopened.
+var errNotLoaded = errors.New("database not loaded")
+
+// An error of one of the kinds above, with the underlying cause.
+type lookupError struct {
+	kind error
+	err  error
+}
+
+func (e *lookupError) Error() string {
+	return e.kind.Error() + ": " + e.err.Error()
+}
+
+// So that errors.Is matches the kind, as well as the cause through Unwrap.
+func (e *lookupError) Is(target error) bool {
+	return target == e.kind
+}
+
+func (e *lookupError) Unwrap() error {
+	return e.err
+}
+
+// Wrap a database error.
+func databaseError(err error) error {
+	return &lookupError{kind: ErrDatabase, err: err}
+}
+
+// The kind of a lookup error, for comparison with ErrInvalidIP, ErrNotFound
+// and ErrDatabase.
+func errorKind(err error) error {
+	if e, ok := err.(*lookupError); ok {
+		return e.kind
+	}
+	return err
+}
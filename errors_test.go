@@ -0,0 +1,25 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+// A wrapped database error matches its kind and its cause.
+func TestLookupErrorIs(t *testing.T) {
+
+	err := databaseError(errNotLoaded)
+	if !errors.Is(err, ErrDatabase) {
+		t.Errorf("%v isn't ErrDatabase", err)
+	}
+	if !errors.Is(err, errNotLoaded) {
+		t.Errorf("%v isn't its cause", err)
+	}
+	if errors.Is(err, ErrNotFound) {
+		t.Errorf("%v is ErrNotFound", err)
+	}
+	if errorKind(err) != ErrDatabase {
+		t.Errorf("%v: kind %v", err, errorKind(err))
+	}
+
+}
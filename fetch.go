@@ -0,0 +1,231 @@
+//
+// Remote database loading.  When GEOIP_DB_URL / GEOIP_ASN_DB_URL are set, the
+// database is downloaded to its local filename before each open.  The URL
+// must serve the .mmdb file itself, optionally gzipped (URL ending ".gz").
+//
+// Fetches are conditional, on the ETag and Last-Modified time the server
+// last sent, so an unchanged database isn't downloaded again.  A downloaded
+// file takes the server's Last-Modified time as its modification time, which
+// also makes the first fetch after a restart conditional.
+//
+// Each URL has a circuit breaker.  After a number of consecutive failures
+// (GEOIP_FETCH_FAILURES, default 3) fetches stop for a cooldown window
+// (GEOIP_FETCH_COOLDOWN, default 5m) and the last good local copy is used.
+// After the cooldown a single trial fetch decides whether to close the
+// breaker again.
+//
+
+package main
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/oschwald/geoip2-golang"
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+// Circuit breaker states.
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half-open"
+)
+
+// Returned by fetch when the breaker is open.
+var errBreakerOpen = errors.New("circuit breaker open")
+
+// Returned by fetch when the server's copy hasn't changed.
+var errNotModified = errors.New("not modified")
+
+// Circuit breaker for one remote source.
+type breaker struct {
+	name      string
+	threshold int
+	cooldown  time.Duration
+
+	state    string
+	failures int
+	openedAt time.Time
+}
+
+func newBreaker(name string, threshold int, cooldown time.Duration) *breaker {
+	return &breaker{
+		name:      name,
+		threshold: threshold,
+		cooldown:  cooldown,
+		state:     breakerClosed,
+	}
+}
+
+// Change state, logging the transition.
+func (b *breaker) setState(state string) {
+	if b.state != state {
+		utils.Log("%s fetch circuit breaker: %s -> %s", b.name, b.state,
+			state)
+		b.state = state
+	}
+}
+
+// Whether an attempt may be made now.
+func (b *breaker) allow() bool {
+	if b.state == breakerOpen {
+		if time.Since(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.setState(breakerHalfOpen)
+	}
+	return true
+}
+
+// Record a successful attempt.
+func (b *breaker) success() {
+	b.failures = 0
+	b.setState(breakerClosed)
+}
+
+// Record a failed attempt.
+func (b *breaker) failure() {
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.threshold {
+		b.openedAt = time.Now()
+		b.setState(breakerOpen)
+	}
+}
+
+// A remote database source.
+type remoteDB struct {
+	url     string
+	breaker *breaker
+	client  *http.Client
+
+	// Validators from the last download, empty if unknown.
+	etag         string
+	lastModified string
+}
+
+func newRemoteDB(name, url string, threshold int,
+	cooldown time.Duration) *remoteDB {
+	return &remoteDB{
+		url:     url,
+		breaker: newBreaker(name, threshold, cooldown),
+		client:  &http.Client{Timeout: 5 * time.Minute},
+	}
+}
+
+// Fetch the database to a local file, going through the breaker.  The file
+// is only replaced once the download is known to be a readable database.
+func (r *remoteDB) fetch(filename string) error {
+
+	if !r.breaker.allow() {
+		return errBreakerOpen
+	}
+
+	err := r.download(filename)
+	if err != nil && err != errNotModified {
+		r.breaker.failure()
+		return err
+	}
+
+	r.breaker.success()
+	return err
+
+}
+
+// Download to a temporary file, check it, and move into place, unless the
+// server's copy hasn't changed since the local one was downloaded.
+func (r *remoteDB) download(filename string) error {
+
+	req, err := http.NewRequest("GET", r.url, nil)
+	if err != nil {
+		return err
+	}
+
+	// Conditional on the last download, or, after a restart, the local
+	// copy's time.  Without a local copy, it's always wanted.
+	if info, err := os.Stat(filename); err == nil {
+		if r.etag != "" {
+			req.Header.Set("If-None-Match", r.etag)
+		}
+		if r.lastModified != "" {
+			req.Header.Set("If-Modified-Since", r.lastModified)
+		} else {
+			req.Header.Set("If-Modified-Since",
+				info.ModTime().UTC().Format(http.TimeFormat))
+		}
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified {
+		return errNotModified
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("HTTP status %s", resp.Status)
+	}
+
+	var body io.Reader = resp.Body
+	if strings.HasSuffix(resp.Request.URL.Path, ".gz") {
+		gz, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		body = gz
+	}
+
+	tmp := filename + ".download"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(f, body)
+	if err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	// Make sure it opens before replacing the last good copy.
+	db, err := geoip2.Open(tmp)
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	db.Close()
+
+	// The server's time, so the file's time says which copy it is.
+	lastModified := resp.Header.Get("Last-Modified")
+	if t, err := http.ParseTime(lastModified); err == nil {
+		err = os.Chtimes(tmp, t, t)
+		if err != nil {
+			os.Remove(tmp)
+			return err
+		}
+	}
+
+	err = os.Rename(tmp, filename)
+	if err != nil {
+		return err
+	}
+
+	r.etag = resp.Header.Get("ETag")
+	r.lastModified = lastModified
+	return nil
+
+}
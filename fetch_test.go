@@ -0,0 +1,74 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// An unchanged remote database isn't downloaded again, and a downloaded one
+// takes the server's modification time.
+func TestFetchConditional(t *testing.T) {
+
+	dir, cleanup := testDir(t)
+	defer cleanup()
+
+	src := testDB(t, dir, "served.mmdb", "GeoLite2-City", 1, nil)
+	data, err := ioutil.ReadFile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	modified := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	downloads := 0
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			if req.Header.Get("If-None-Match") == `"v1"` {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			downloads++
+			w.Header().Set("ETag", `"v1"`)
+			w.Header().Set("Last-Modified",
+				modified.Format(http.TimeFormat))
+			w.Write(data)
+		}))
+	defer srv.Close()
+
+	local := filepath.Join(dir, "GeoLite2-City.mmdb")
+	r := newRemoteDB("City", srv.URL, 3, time.Minute)
+
+	err = r.fetch(local)
+	if err != nil {
+		t.Fatalf("first fetch: %s", err.Error())
+	}
+	info, err := os.Stat(local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.ModTime().Equal(modified) {
+		t.Errorf("modification time %s, wanted %s", info.ModTime(),
+			modified)
+	}
+
+	err = r.fetch(local)
+	if err != errNotModified {
+		t.Errorf("second fetch gave %v, wanted not modified", err)
+	}
+	if downloads != 1 {
+		t.Errorf("%d downloads, wanted 1", downloads)
+	}
+
+	// Without the local copy, it's downloaded again.
+	os.Remove(local)
+	err = r.fetch(local)
+	if err != nil || downloads != 2 {
+		t.Errorf("fetch without local copy: %v, %d downloads", err,
+			downloads)
+	}
+
+}
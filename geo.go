@@ -0,0 +1,90 @@
+//
+// Geographic helpers.
+//
+
+package main
+
+import (
+	"math"
+)
+
+// Mean radius of the Earth, in kilometres.
+const earthRadiusKm = 6371.0
+
+// Great-circle distance in kilometres between two points given in degrees.
+func haversine(lat1, lon1, lat2, lon2 float64) float64 {
+
+	rad := math.Pi / 180.0
+
+	dLat := (lat2 - lat1) * rad
+	dLon := (lon2 - lon1) * rad
+
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1*rad)*math.Cos(lat2*rad)*
+			math.Sin(dLon/2)*math.Sin(dLon/2)
+
+	return 2 * earthRadiusKm * math.Asin(math.Sqrt(a))
+
+}
+
+// Length of each accuracy radius unit, in kilometres.
+var accuracyUnits = map[string]float64{
+	"km": 1.0,
+	"m":  0.001,
+	"mi": 1.609344,
+}
+
+// Round to a number of decimal places.
+func round(v float64, decimals int) float64 {
+	p := math.Pow(10, float64(decimals))
+	return math.Floor(v*p+0.5) / p
+}
+
+// Geohash alphabet.
+const geohashBase32 = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+// Geohash of a point given in degrees, to the given number of characters.
+func geohash(lat, lon float64, precision int) string {
+
+	latRange := [2]float64{-90.0, 90.0}
+	lonRange := [2]float64{-180.0, 180.0}
+
+	hash := make([]byte, 0, precision)
+	even := true
+	bit := 0
+	ch := 0
+
+	for len(hash) < precision {
+
+		// Even bits bisect longitude, odd bits latitude.
+		var r *[2]float64
+		var v float64
+		if even {
+			r, v = &lonRange, lon
+		} else {
+			r, v = &latRange, lat
+		}
+
+		mid := (r[0] + r[1]) / 2
+		ch <<= 1
+		if v >= mid {
+			ch |= 1
+			r[0] = mid
+		} else {
+			r[1] = mid
+		}
+		even = !even
+
+		// Five bits per character.
+		bit++
+		if bit == 5 {
+			hash = append(hash, geohashBase32[ch])
+			bit = 0
+			ch = 0
+		}
+
+	}
+
+	return string(hash)
+
+}
@@ -11,10 +11,17 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
 	"net"
 	"os"
 	"os/exec"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/oschwald/geoip2-golang"
@@ -26,206 +33,2015 @@ import (
 
 const (
 
-	// Program name, used for log entries.
+	// Default program name, used for log entries and as the worker name.
+	// Overridden by GEOIP_NAME or the -name flag.
 	pgm = "geoip"
 
 	// How often to update GeoIP data.
 	updatePeriod = 86400 * time.Second
+
+	// Output events are sent to, unless routed elsewhere.
+	defaultOutput = "output"
+)
+
+// geoipupdate command, its configuration file and the database directory.
+// Overridable through the environment, e.g. to substitute a stub command.
+var (
+	updateCommand = utils.Getenv("GEOIPUPDATE_PATH", "geoipupdate")
+	updateConfig  = utils.Getenv("GEOIPUPDATE_CONF", "GeoIP.conf")
+	updateDir     = utils.Getenv("GEOIPUPDATE_DIR", ".")
+)
+
+// How long geoipupdate may run before it is killed, from
+// GEOIPUPDATE_TIMEOUT.
+var updateTimeout = 5 * time.Minute
+
+// Returned by runUpdate when geoipupdate was killed for taking too long.
+var errUpdateTimeout = errors.New("geoipupdate timed out")
+
+// Consecutive geoipupdate failures after which the updater falls back to
+// the database URLs, from GEOIPUPDATE_FALLBACK_FAILURES.  0 if there are no
+// URLs, or the fallback is turned off.
+var updateFallbackFailures = 3
+
+// Read update settings which can fail to parse.
+func initUpdate() error {
+	var err error
+	updateTimeout, err = getenvDuration("GEOIPUPDATE_TIMEOUT", updateTimeout)
+	if err != nil {
+		return err
+	}
+	updateFallbackFailures, err = getenvInt("GEOIPUPDATE_FALLBACK_FAILURES",
+		updateFallbackFailures)
+	if err != nil {
+		return err
+	}
+	if utils.Getenv("GEOIP_DB_URL", "") == "" &&
+		utils.Getenv("GEOIP_ASN_DB_URL", "") == "" {
+		updateFallbackFailures = 0
+	}
+	return nil
+}
+
+// An update in progress.  done is closed once out and err are set.
+type updateRun struct {
+	done chan bool
+	out  []byte
+	err  error
+}
+
+// The update in progress, nil if none, and the lock guarding it.
+var (
+	updateLock    sync.Mutex
+	currentUpdate *updateRun
 )
 
-// Goroutine: GeoIP updater.  Periodically runs geoipupdate.
-func updater(notif chan bool) {
+// Run geoipupdate once, returning its combined stdout/stderr.  Only one
+// geoipupdate runs at a time, whatever triggered it: a trigger while an
+// update is running waits for that update and gets its result.
+func runUpdate() ([]byte, error) {
+
+	updateLock.Lock()
+	if r := currentUpdate; r != nil {
+		updateLock.Unlock()
+		utils.Log("Update already running, waiting for its result.")
+		<-r.done
+		return r.out, r.err
+	}
+	r := &updateRun{done: make(chan bool)}
+	currentUpdate = r
+	updateLock.Unlock()
+
+	r.out, r.err = execUpdate()
+
+	updateLock.Lock()
+	currentUpdate = nil
+	updateLock.Unlock()
+	close(r.done)
+
+	return r.out, r.err
+
+}
+
+// Execute geoipupdate.
+func execUpdate() ([]byte, error) {
+
+	utils.Log("Running GeoIP update...")
+
+	// Create geoipupdate command, killed if it stalls.
+	ctx, cancel := context.WithTimeout(context.Background(), updateTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, updateCommand, updateArgs()...)
+
+	// Execute, stdout/stderr to byte array.
+	out, err := cmd.CombinedOutput()
+	if ctx.Err() == context.DeadlineExceeded {
+		return out, errUpdateTimeout
+	}
+	return out, err
+
+}
+
+// Arguments for geoipupdate.  When the account ID, license key and edition
+// IDs are all in the environment, geoipupdate reads them from there itself
+// (it inherits our environment), and the config file is left out.
+func updateArgs() []string {
+	if os.Getenv("GEOIPUPDATE_ACCOUNT_ID") != "" &&
+		os.Getenv("GEOIPUPDATE_LICENSE_KEY") != "" &&
+		os.Getenv("GEOIPUPDATE_EDITION_IDS") != "" {
+		return []string{"-d", updateDir}
+	}
+	return []string{"-f", updateConfig, "-d", updateDir}
+}
+
+// Ping the main goroutine, so it knows to reopen the GeoIP database.  If
+// a notification is already pending, there's no need for another.
+func notify(notif chan bool) {
+	select {
+	case notif <- true:
+	default:
+	}
+}
+
+// Goroutine: GeoIP updater.  Periodically runs geoipupdate.  If that keeps
+// failing and database URLs are configured, falls back to those: the reload
+// that follows a notification fetches from them.
+func updater(notif chan bool) {
+
+	var waitTime = updatePeriod
+	failures := 0
+
+	for {
+
+		// Wait appropriate sleep period.
+		time.Sleep(waitTime)
+
+		out, err := runUpdate()
+		if err == errUpdateTimeout {
+			utils.Log("Update timed out after %s, killed geoipupdate.",
+				updateTimeout)
+			utils.Log("geoipupdate: %s", out)
+		} else if err != nil {
+			utils.Log("Update error: %s", err.Error())
+			utils.Log("geoipupdate: %s", out)
+		}
+
+		if err != nil {
+
+			// Failed: Retry sooner than the long period, unless it's
+			// time to try the URLs instead.
+			waitTime = 60 * time.Second
+			failures++
+			if updateFallbackFailures > 0 &&
+				failures >= updateFallbackFailures {
+				utils.Log("geoipupdate failed %d times in a row, updating "+
+					"by direct download instead.", failures)
+				failures = 0
+				waitTime = updatePeriod
+				notify(notif)
+			}
+			continue
+
+		}
+
+		failures = 0
+		utils.Log("GeoIP updated by geoipupdate, success.")
+
+		// On successful update, wait period is a long period.
+		waitTime = updatePeriod
+
+		// Ping the main goroutine, so it knows to reopen the
+		// GeoIP database.
+		notify(notif)
+
+	}
+
+}
+
+type work struct {
+
+	// Held for writing while databases are swapped, and for reading while
+	// the databases or anything derived from them are in use.  Handle may
+	// run concurrently, one call per input queue.
+	lock sync.RWMutex
+
+	// Held while databases are opened or reloaded, so that only one
+	// goroutine changes them, and they can be read without the lock
+	// while replacements are fetched and opened.
+	reloadLock sync.Mutex
+
+	// GeoIP location (City, or Country if countryOnly) and ASN databases.
+	cityDB      *database
+	asnDB       *database
+	countryOnly bool
+
+	// Whether the location database is an Enterprise one, which also
+	// holds the ASN and ISP data.  There's no ASN database then.
+	enterprise bool
+
+	// Whether the registered country, rather than the physical one, fills
+	// the primary country fields.
+	registeredCountry bool
+
+	// Which subdivision level fills the subdivision fields: an index from
+	// the largest, or -1 for the most specific.
+	subdivisionLevel int
+
+	// Optional Anonymous-IP and ISP databases, nil if not configured.
+	anonDB *database
+	ispDB  *database
+
+	// Address family preference for source/destination extraction:
+	// "first", "v4" or "v6".
+	srcFamilyPref  string
+	destFamilyPref string
+
+	// ASNs whose addresses are not geo-tagged.
+	excludeASN map[uint]bool
+
+	// Registered country by ASN, nil if not configured.
+	asnCountries map[uint]string
+
+	// Whether to flag places outside their ASN's country.
+	flagCountryASN bool
+
+	// Names for ASNs the ASN database has no organisation for, nil if not
+	// configured.
+	asnNames map[uint]string
+
+	// Whether to add ASN prefix counts, and the counts by ASN.
+	asnPrefixCount bool
+	asnPrefixes    map[uint]int
+
+	// RIR delegations, nil if disabled.
+	rir *rirTable
+
+	// Name locales, in order of preference.
+	locales []string
+
+	// Whether CGNAT addresses are looked up rather than skipped, for
+	// networks whose databases map them.
+	lookupCGNAT bool
+
+	// NAT64 prefixes, for looking up embedded IPv4 addresses.
+	nat64 nat64Prefixes
+
+	// Ranges which are never geolocated, for compliance.
+	deny []*net.IPNet
+
+	// Anycast ranges, and whether their positions are left out.
+	anycast           []*net.IPNet
+	anycastNoPosition bool
+
+	// Enrichment profiles by event action, and for other actions.
+	profiles       map[string]profile
+	defaultProfile profile
+
+	// Fixed locations for address ranges, nil if none.
+	overrides *overrides
+
+	notif chan bool
+
+	// Reference point for source distance annotation.
+	hasReference bool
+	referenceLat float64
+	referenceLon float64
+
+	// Country centroids used when city coordinates are missing, nil if
+	// the fallback is disabled.
+	centroids map[string][2]float64
+
+	// Whether to add calling code and currency for the country.
+	countryMetadata bool
+
+	// Whether to add GeoNames IDs.
+	geoNameIDs bool
+
+	// Whether to add the precision level, and the largest accuracy radius
+	// which counts as exact.
+	precision     bool
+	exactRadiusKm int
+
+	// Whether to add the country's flag emoji.
+	flagEmoji bool
+
+	// Whether to add the alpha-3 country code.
+	alpha3 bool
+
+	// Whether to add the static IP score.  Only Enterprise databases have
+	// it.
+	staticIPScore bool
+
+	// Whether to add the time zone, and its UTC offset at event time.
+	timeZone  bool
+	utcOffset bool
+
+	// GeoJSON position mode: "" (off), "add" or "replace".
+	geoJSON string
+
+	// Full locations by location hash, in hash mode.
+	locationHashes *lru
+
+	// Geohash length, 0 for no geohash.
+	geohashPrecision int
+
+	// Unit for the additional accuracy radius field, "km" for none, and
+	// decimal places it is rounded to.
+	accuracyUnit     string
+	accuracyDecimals int
+
+	// Location by address, nil if disabled, and the file it persists to.
+	cache     *lru
+	cacheFile string
+
+	// Configured address and flow cache sizes.
+	cacheSize     int
+	flowCacheSize int
+
+	// Times the memory guard has halved the cache sizes, 0 if it hasn't.
+	cacheShift uint
+
+	// Known-hot addresses looked up after each open, empty for none.
+	prewarmFile string
+
+	// Cache lookups go through: the LRU above, or nil if disabled or
+	// shared in Redis.
+	addrCache addrCache
+
+	// Shared Redis cache, nil if not used.
+	redisCache *redisCache
+
+	// Location information by src|dest flow key, nil if disabled.
+	flowCache *lru
+
+	// Message size limit in bytes, 0 for no limit, and whether oversize
+	// messages are forwarded unchanged rather than dropped.
+	maxMessageSize  int
+	forwardOversize bool
+
+	// Output envelope, and its name.
+	formatter    formatter
+	outputFormat string
+
+	// Whether to stamp locations with the enrichment time.
+	stampTime bool
+
+	// Whether to add flat top-level location fields too.
+	emitBoth bool
+
+	// Risk score signal weights, nil if scoring is off.
+	riskWeights map[string]float64
+
+	// Whether to attach locations for both families of dual-stack
+	// endpoints.
+	dualStack bool
+
+	// Whether to merge into a location already on the event, rather than
+	// replace it.
+	mergeLocation bool
+
+	// Whether to flag events with reserved addresses.
+	tagReserved bool
+
+	// Whether to name the destination port's service.
+	destService bool
+
+	// Per-endpoint records: "", "also" or "only", and their output, empty
+	// for the event's.
+	endpointMode   string
+	endpointOutput string
+
+	// Location attribute used as the partition key: "", "iso" or "asn".
+	partitionBy string
+
+	// Fraction of events enriched, 1.0 for all.
+	sampleRate float64
+
+	// Reaction to a slow output, nil if disabled.
+	backpressure *backpressure
+
+	// Log for errors which may repeat on every event.
+	errLog *rateLog
+
+	// Address for the HTTP control endpoint, empty to disable.
+	httpAddr string
+
+	// Settings file, empty if none, the values last read from it, and the
+	// environment values of the runtime settings it may override.
+	configFile   string
+	configValues map[string]string
+	baseEnv      map[string]string
+
+	// Held for reading by each Handle call, and for writing by drain, so
+	// that drain waits for in-flight events and holds off new ones.
+	active sync.RWMutex
+
+	// How long shutdown waits for in-flight events.
+	drainTimeout time.Duration
+
+	// Event field naming the output for that event, empty to disable, and
+	// the outputs it may name.
+	routeField string
+	outputs    map[string]bool
+
+	// Output for events which keep failing, empty to disable, attempts
+	// before an event goes there, and attempts so far by message digest.
+	deadLetterOutput string
+	maxAttempts      int
+	attempts         *lru
+
+	// Audit log settings, nil to disable.
+	audit *auditLog
+
+	// Windowed summary counts, nil to disable.
+	summary *summary
+
+	// Enrichment span exporter, nil to disable.
+	tracer *tracer
+
+	// Where events are written instead of the output queues, nil to use
+	// the queues, and the lock serialising writes.
+	localOut  io.Writer
+	localLock sync.Mutex
+}
+
+// Open GeoIP databases.  Doesn't return until the required ones are open.
+// An optional database which is present but unusable is an error if
+// strict is set.
+func (s *work) openGeoIP(strict bool) error {
+	s.reloadLock.Lock()
+	defer s.reloadLock.Unlock()
+	for _, d := range s.requiredDBs() {
+		d.open(&s.lock)
+	}
+	if s.asnDB.loaded() {
+		if counts := s.prefixCounts(s.asnDB.raw); counts != nil {
+			s.asnPrefixes = counts
+		}
+	}
+	for _, d := range s.optionalDBs() {
+		err := d.openOptional(&s.lock)
+		if err != nil && strict {
+			return err
+		}
+	}
+	return nil
+}
+
+// The databases which must be open to handle events.
+func (s *work) requiredDBs() []*database {
+	if s.asnDB == nil {
+		return []*database{s.cityDB}
+	}
+	return []*database{s.cityDB, s.asnDB}
+}
+
+// The optional databases which are configured.
+func (s *work) optionalDBs() []*database {
+	var dbs []*database
+	for _, d := range []*database{s.anonDB, s.ispDB} {
+		if d != nil {
+			dbs = append(dbs, d)
+		}
+	}
+	return dbs
+}
+
+// Reopen any GeoIP databases whose files have changed.  Replacements are
+// fetched and opened before the lock is taken, so events are handled
+// meanwhile; the lock is only held while the readers are swapped.
+func (s *work) reloadGeoIP() {
+
+	s.reloadLock.Lock()
+	defer s.reloadLock.Unlock()
+
+	dbs := append(s.requiredDBs(), s.optionalDBs()...)
+	updates := make([]*openedDB, len(dbs))
+	changed := false
+	for i, d := range dbs {
+		updates[i] = d.update()
+		if updates[i] != nil {
+			changed = true
+		}
+	}
+
+	if !changed {
+		utils.Log("GeoIP databases unchanged, nothing to reload.")
+		return
+	}
+
+	// Count a new ASN database's prefixes before it is swapped in.
+	var counts map[uint]int
+	for i, d := range dbs {
+		if d == s.asnDB && updates[i] != nil {
+			counts = s.prefixCounts(updates[i].raw)
+		}
+	}
+
+	s.lock.Lock()
+
+	for i, d := range dbs {
+		if updates[i] != nil {
+			d.install(updates[i])
+			utils.Log("Reopened GeoIP %s database.", d.name)
+		}
+	}
+	if counts != nil {
+		s.asnPrefixes = counts
+	}
+
+	// Cached locations may be out of date.  Entries combine results from
+	// all the databases, so any change invalidates them.
+	if s.cache != nil {
+		s.cache.purge()
+	}
+	if s.flowCache != nil {
+		s.flowCache.purge()
+	}
+
+	s.lock.Unlock()
+
+	// Rewarm once the lock is released.
+	go s.prewarm()
+
+}
+
+// Initialisation
+func (s *work) init(notif chan bool) error {
+
+	s.notif = notif
+
+	// Identical errors are logged at most once a minute.
+	s.errLog = newRateLog(time.Minute)
+
+	// Settings file, over the environment.
+	err := s.initConfigFile()
+	if err != nil {
+		return err
+	}
+
+	// Optional remote sources, with circuit breaker settings.
+	threshold, err := getenvInt("GEOIP_FETCH_FAILURES", 3)
+	if err != nil {
+		return err
+	}
+	cooldown, err := getenvDuration("GEOIP_FETCH_COOLDOWN", 5*time.Minute)
+	if err != nil {
+		return err
+	}
+	var cityRemote, asnRemote *remoteDB
+	if url := utils.Getenv("GEOIP_DB_URL", ""); url != "" {
+		cityRemote = newRemoteDB("City", url, threshold, cooldown)
+	}
+	if url := utils.Getenv("GEOIP_ASN_DB_URL", ""); url != "" {
+		asnRemote = newRemoteDB("ASN", url, threshold, cooldown)
+	}
+
+	// Location database type: "city", the lighter "country", or
+	// "enterprise", whose one file replaces the City, ASN and ISP ones.
+	switch dbType := utils.Getenv("GEOIP_DB_TYPE", "city"); dbType {
+	case "city":
+	case "country":
+		s.countryOnly = true
+	case "enterprise":
+		s.enterprise = true
+	default:
+		return fmt.Errorf("GEOIP_DB_TYPE: unknown type: %s", dbType)
+	}
+
+	// Database filenames are environment variables.
+	switch {
+	case s.countryOnly:
+		s.cityDB = newDatabase("Country",
+			utils.Getenv("GEOIP_DB", "GeoLite2-Country.mmdb"),
+			cityRemote)
+	case s.enterprise:
+		s.cityDB = newDatabase("Enterprise",
+			utils.Getenv("GEOIP_DB", "GeoIP2-Enterprise.mmdb"),
+			cityRemote)
+		s.cityDB.edition = "Enterprise"
+	default:
+		s.cityDB = newDatabase("City",
+			utils.Getenv("GEOIP_DB", "GeoLite2-City.mmdb"), cityRemote)
+		s.cityDB.expectCity = true
+	}
+	if !s.enterprise {
+		s.asnDB = newDatabase("ASN",
+			utils.Getenv("GEOIP_ASN_DB", "GeoLite2-ASN.mmdb"), asnRemote)
+	}
+	if f := utils.Getenv("GEOIP_ANON_DB", ""); f != "" {
+		s.anonDB = newDatabase("Anonymous-IP", f, nil)
+		s.anonDB.edition = "Anonymous-IP"
+	}
+	if f := utils.Getenv("GEOIP_ISP_DB", ""); f != "" {
+		s.ispDB = newDatabase("ISP", f, nil)
+		s.ispDB.edition = "ISP"
+	}
+
+	// How each database is opened.
+	for _, db := range []struct {
+		prefix string
+		d      *database
+	}{{"GEOIP_DB", s.cityDB}, {"GEOIP_ASN_DB", s.asnDB},
+		{"GEOIP_ANON_DB", s.anonDB}, {"GEOIP_ISP_DB", s.ispDB}} {
+		if db.d == nil {
+			continue
+		}
+		db.d.opts, err = dbOptions(db.prefix)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Which country is the primary country.
+	switch src := utils.Getenv("GEOIP_COUNTRY_SOURCE", "physical"); src {
+	case "physical":
+	case "registered":
+		s.registeredCountry = true
+	default:
+		return fmt.Errorf("GEOIP_COUNTRY_SOURCE: unknown source: %s", src)
+	}
+
+	// Which subdivision level is reported.
+	switch level := utils.Getenv("GEOIP_SUBDIVISION_LEVEL", "first"); level {
+	case "first":
+	case "last":
+		s.subdivisionLevel = -1
+	default:
+		s.subdivisionLevel, err = strconv.Atoi(level)
+		if err != nil || s.subdivisionLevel < 0 {
+			return fmt.Errorf("GEOIP_SUBDIVISION_LEVEL: bad level: %s",
+				level)
+		}
+	}
+
+	// Guard against reopening into a truncated database.
+	tolerance, err := getenvFloat("GEOIP_SHRINK_TOLERANCE", 0.5)
+	if err != nil {
+		return err
+	}
+	for _, d := range append(s.requiredDBs(), s.optionalDBs()...) {
+		d.shrinkTolerance = tolerance
+	}
+
+	// Address family preference, overridable per direction.
+	pref := utils.Getenv("GEOIP_ADDR_FAMILY_PREF", "first")
+	s.srcFamilyPref = utils.Getenv("GEOIP_SRC_ADDR_FAMILY_PREF", pref)
+	s.destFamilyPref = utils.Getenv("GEOIP_DEST_ADDR_FAMILY_PREF", pref)
+	for _, v := range []string{s.srcFamilyPref, s.destFamilyPref} {
+		if v != "first" && v != "v4" && v != "v6" {
+			return fmt.Errorf("invalid address family preference: %s", v)
+		}
+	}
+
+	// Comma-separated prefixes of IP addresses in address lists.
+	if v, ok := os.LookupEnv("GEOIP_ADDR_PREFIXES"); ok {
+		addrPrefixes = strings.Split(v, ",")
+		for i := range addrPrefixes {
+			addrPrefixes[i] = strings.TrimSpace(addrPrefixes[i])
+		}
+	}
+
+	// Address list entry encoding.
+	addrEncoding = utils.Getenv("GEOIP_ADDR_ENCODING", "prefixed")
+	if addrEncoding != "prefixed" && addrEncoding != "object" {
+		return fmt.Errorf("GEOIP_ADDR_ENCODING: unknown encoding: %s",
+			addrEncoding)
+	}
+	addrTypeKey = utils.Getenv("GEOIP_ADDR_TYPE_KEY", addrTypeKey)
+	addrValueKey = utils.Getenv("GEOIP_ADDR_VALUE_KEY", addrValueKey)
+
+	// Destination port service names.
+	s.destService, err = getenvBool("GEOIP_DEST_SERVICE", false)
+	if err != nil {
+		return err
+	}
+
+	// Address list scan limit.
+	maxAddrs, err = getenvInt("GEOIP_MAX_ADDRS", maxAddrs)
+	if err != nil {
+		return err
+	}
+	if maxAddrs < 0 {
+		return fmt.Errorf("GEOIP_MAX_ADDRS: must not be negative")
+	}
+
+	// Comma-separated list of ASNs to exclude from enrichment.
+	s.excludeASN = map[uint]bool{}
+	for _, v := range strings.Split(utils.Getenv("GEOIP_EXCLUDE_ASN", ""), ",") {
+		v = strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(v)), "AS")
+		if v == "" {
+			continue
+		}
+		asn, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			return fmt.Errorf("GEOIP_EXCLUDE_ASN: invalid ASN: %s", v)
+		}
+		s.excludeASN[uint(asn)] = true
+	}
+
+	// Optional reference point, both coordinates must be given.
+	lat := utils.Getenv("GEOIP_REFERENCE_LAT", "")
+	lon := utils.Getenv("GEOIP_REFERENCE_LON", "")
+	if lat != "" || lon != "" {
+		s.referenceLat, err = strconv.ParseFloat(lat, 64)
+		if err != nil {
+			return fmt.Errorf("GEOIP_REFERENCE_LAT: %s", err.Error())
+		}
+		s.referenceLon, err = strconv.ParseFloat(lon, 64)
+		if err != nil {
+			return fmt.Errorf("GEOIP_REFERENCE_LON: %s", err.Error())
+		}
+		s.hasReference = true
+	}
+
+	// ASN registered countries.
+	if file := utils.Getenv("GEOIP_ASN_COUNTRY_FILE", ""); file != "" {
+		s.asnCountries, err = loadASNCountries(file)
+		if err != nil {
+			return fmt.Errorf("ASN countries: %s", err.Error())
+		}
+	}
+	s.flagCountryASN, err = getenvBool("GEOIP_COUNTRY_ASN_MISMATCH", false)
+	if err != nil {
+		return err
+	}
+	if s.flagCountryASN && s.asnCountries == nil {
+		return fmt.Errorf("GEOIP_COUNTRY_ASN_MISMATCH: needs " +
+			"GEOIP_ASN_COUNTRY_FILE")
+	}
+
+	// Fallback ASN names.
+	if file := utils.Getenv("GEOIP_ASN_NAMES_FILE", ""); file != "" {
+		s.asnNames, err = loadASNNames(file)
+		if err != nil {
+			return fmt.Errorf("ASN names: %s", err.Error())
+		}
+	}
+
+	// ASN prefix counts.
+	s.asnPrefixCount, err = getenvBool("GEOIP_ASN_PREFIX_COUNT", false)
+	if err != nil {
+		return err
+	}
+
+	// RIR enrichment, from the bundled blocks and any delegation files.
+	useRIR, err := getenvBool("GEOIP_RIR", false)
+	if err != nil {
+		return err
+	}
+	rirFiles := utils.Getenv("GEOIP_RIR_FILES", "")
+	if useRIR || rirFiles != "" {
+		var files []string
+		if rirFiles != "" {
+			files = strings.Split(rirFiles, ",")
+		}
+		s.rir, err = loadRIR(files)
+		if err != nil {
+			return fmt.Errorf("RIR delegations: %s", err.Error())
+		}
+	}
+
+	// CGNAT addresses are skipped unless they're known to be mapped.
+	s.lookupCGNAT, err = getenvBool("GEOIP_LOOKUP_CGNAT", false)
+	if err != nil {
+		return err
+	}
+
+	// NAT64 prefixes, whose addresses are also looked up by the embedded
+	// IPv4 address.
+	s.nat64, err = parseNAT64Prefixes(utils.Getenv("GEOIP_NAT64_PREFIXES",
+		"64:ff9b::/96"))
+	if err != nil {
+		return fmt.Errorf("GEOIP_NAT64_PREFIXES: %s", err.Error())
+	}
+
+	// Denylisted ranges.
+	s.deny, err = parseCIDRList(utils.Getenv("GEOIP_DENY_CIDRS", ""))
+	if err != nil {
+		return fmt.Errorf("GEOIP_DENY_CIDRS: %s", err.Error())
+	}
+
+	// Anycast ranges.
+	s.anycast, err = parseCIDRList(utils.Getenv("GEOIP_ANYCAST_CIDRS", ""))
+	if err != nil {
+		return fmt.Errorf("GEOIP_ANYCAST_CIDRS: %s", err.Error())
+	}
+	s.anycastNoPosition, err = getenvBool("GEOIP_ANYCAST_SUPPRESS_POSITION",
+		false)
+	if err != nil {
+		return err
+	}
+
+	// Enrichment profiles.
+	s.profiles, err = parseProfiles(utils.Getenv("GEOIP_PROFILES", ""))
+	if err != nil {
+		return fmt.Errorf("GEOIP_PROFILES: %s", err.Error())
+	}
+	s.defaultProfile, err = parseProfile(utils.Getenv("GEOIP_DEFAULT_PROFILE",
+		"full"))
+	if err != nil {
+		return fmt.Errorf("GEOIP_DEFAULT_PROFILE: %s", err.Error())
+	}
+
+	// Location overrides for address ranges.
+	if file := utils.Getenv("GEOIP_OVERRIDES", ""); file != "" {
+		s.overrides, err = loadOverrides(file)
+		if err != nil {
+			return fmt.Errorf("overrides: %s", err.Error())
+		}
+	}
+
+	// Location object key style and explicit renames.
+	err = initKeyRemap(utils.Getenv("GEOIP_KEY_STYLE", ""),
+		utils.Getenv("GEOIP_KEY_MAP", ""))
+	if err != nil {
+		return err
+	}
+
+	// Country centroid fallback.  Giving a centroid file enables it too.
+	useCentroids, err := getenvBool("GEOIP_COUNTRY_CENTROIDS", false)
+	if err != nil {
+		return err
+	}
+	centroidFile := utils.Getenv("GEOIP_CENTROID_FILE", "")
+	if useCentroids || centroidFile != "" {
+		s.centroids, err = loadCentroids(centroidFile)
+		if err != nil {
+			return fmt.Errorf("country centroids: %s", err.Error())
+		}
+	}
+
+	// Settings which can be changed at runtime.
+	err = s.initRuntime()
+	if err != nil {
+		return err
+	}
+	rand.Seed(time.Now().UnixNano())
+
+	// Hash mode, with a bounded record of the locations behind the hashes.
+	hashLocations, err = getenvBool("GEOIP_HASH_LOCATIONS", false)
+	if err != nil {
+		return err
+	}
+	if hashLocations {
+		size, err := getenvInt("GEOIP_HASH_REGISTRY_SIZE", 100000)
+		if err != nil {
+			return err
+		}
+		s.locationHashes = newLRU(size, 0)
+	}
+
+	// Whether to leave out an unresolved direction.
+	omitEmptyDirection, err = getenvBool("GEOIP_OMIT_EMPTY_DIRECTION", false)
+	if err != nil {
+		return err
+	}
+
+	// Optional address cache.
+	if s.cacheSize > 0 {
+		s.cache = newLRU(s.cacheSize, 0)
+	}
+	s.cacheFile = utils.Getenv("GEOIP_CACHE_FILE", "")
+	s.prewarmFile = utils.Getenv("GEOIP_PREWARM_FILE", "")
+	flushInterval, err := getenvDuration("GEOIP_CACHE_FLUSH_INTERVAL",
+		5*time.Minute)
+	if err != nil {
+		return err
+	}
+
+	// Shared Redis cache, instead of the in-process one.
+	if addr := utils.Getenv("GEOIP_CACHE_REDIS", ""); addr != "" {
+		ttl, err := getenvDuration("GEOIP_CACHE_REDIS_TTL", updatePeriod)
+		if err != nil {
+			return err
+		}
+		if ttl < time.Second {
+			return fmt.Errorf("GEOIP_CACHE_REDIS_TTL: must be at least 1s")
+		}
+		s.cache = nil
+		s.redisCache = newRedisCache(addr, ttl, s)
+	} else if s.cache != nil {
+		s.addrCache = localCache{s.cache}
+	}
+
+	// Optional flow cache.  Entries are short-lived, they only need to
+	// cover the events of one flow.
+	flowTTL, err := getenvDuration("GEOIP_FLOW_CACHE_TTL", 10*time.Second)
+	if err != nil {
+		return err
+	}
+	if s.flowCacheSize > 0 {
+		s.flowCache = newLRU(s.flowCacheSize, flowTTL)
+	}
+
+	// Cache figures, as counters and optionally logged.
+	s.publishCacheStats()
+	statsInterval, err := getenvDuration("GEOIP_CACHE_STATS_INTERVAL", 0)
+	if err != nil {
+		return err
+	}
+	if statsInterval > 0 && (s.cache != nil || s.flowCache != nil) {
+		go s.cacheStatsLogger(statsInterval)
+	}
+
+	// Cache size guard against memory pressure.
+	memLimit, err := getenvInt("GEOIP_MEMORY_LIMIT_MB", 0)
+	if err != nil {
+		return err
+	}
+	memInterval, err := getenvDuration("GEOIP_MEMORY_CHECK_INTERVAL",
+		10*time.Second)
+	if err != nil {
+		return err
+	}
+	if memLimit > 0 && memInterval > 0 {
+		go s.memoryGuard(uint64(memLimit)<<20, memInterval)
+	}
+
+	// Liveness heartbeat.
+	heartbeatInterval, err := getenvDuration("GEOIP_HEARTBEAT_INTERVAL", 0)
+	if err != nil {
+		return err
+	}
+	if heartbeatInterval > 0 {
+		go s.heartbeat(heartbeatInterval)
+	}
+
+	// Backpressure from a slow output.
+	bpThreshold, err := getenvDuration("GEOIP_BACKPRESSURE_THRESHOLD", 0)
+	if err != nil {
+		return err
+	}
+	if bpThreshold > 0 {
+		s.backpressure, err = newBackpressure(bpThreshold,
+			utils.Getenv("GEOIP_BACKPRESSURE_ACTION", "shed"))
+		if err != nil {
+			return err
+		}
+	}
+
+	// Message size limit.
+	s.maxMessageSize, err = getenvInt("GEOIP_MAX_MESSAGE_SIZE", 0)
+	if err != nil {
+		return err
+	}
+	switch action := utils.Getenv("GEOIP_OVERSIZE_ACTION", "drop"); action {
+	case "drop":
+	case "forward":
+		s.forwardOversize = true
+	default:
+		return fmt.Errorf("GEOIP_OVERSIZE_ACTION: unknown action: %s",
+			action)
+	}
+
+	// Output envelope.
+	s.outputFormat = utils.Getenv("GEOIP_OUTPUT_FORMAT", "raw")
+	s.formatter, err = newFormatter(s.outputFormat, s)
+	if err != nil {
+		return err
+	}
+
+	// Partition key.  The worker framework doesn't do keyed sends, so
+	// the key is a top-level event field for a downstream partitioner.
+	s.partitionBy = utils.Getenv("GEOIP_PARTITION_KEY", "")
+	if s.partitionBy != "" && s.partitionBy != "iso" &&
+		s.partitionBy != "asn" {
+		return fmt.Errorf("GEOIP_PARTITION_KEY: unknown key: %s",
+			s.partitionBy)
+	}
+
+	// Shutdown drain limit.
+	s.drainTimeout, err = getenvDuration("GEOIP_DRAIN_TIMEOUT",
+		30*time.Second)
+	if err != nil {
+		return err
+	}
+
+	// Content-based output routing.
+	s.routeField = utils.Getenv("GEOIP_ROUTE_FIELD", "")
+
+	// Dead-letter output.
+	s.deadLetterOutput = utils.Getenv("GEOIP_DEAD_LETTER_OUTPUT", "")
+	s.maxAttempts, err = getenvInt("GEOIP_MAX_ATTEMPTS", 3)
+	if err != nil {
+		return err
+	}
+	if s.maxAttempts < 1 {
+		return fmt.Errorf("GEOIP_MAX_ATTEMPTS: must be at least 1")
+	}
+	s.attempts = newLRU(10000, time.Hour)
+
+	// Audit log.
+	audit, err := getenvBool("GEOIP_AUDIT", false)
+	if err != nil {
+		return err
+	}
+	if audit {
+		s.audit = &auditLog{}
+		s.audit.rate, err = getenvFloat("GEOIP_AUDIT_RATE", 1.0)
+		if err != nil {
+			return err
+		}
+		if s.audit.rate < 0.0 || s.audit.rate > 1.0 {
+			return fmt.Errorf("GEOIP_AUDIT_RATE: must be 0.0 to 1.0")
+		}
+		s.audit.max, err = getenvInt("GEOIP_AUDIT_MAX_PER_SECOND", 10)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Aggregated summaries.
+	if output := utils.Getenv("GEOIP_SUMMARY_OUTPUT", ""); output != "" {
+		window, err := getenvDuration("GEOIP_SUMMARY_WINDOW", time.Minute)
+		if err != nil {
+			return err
+		}
+		topK, err := getenvInt("GEOIP_SUMMARY_TOP_K", 10)
+		if err != nil {
+			return err
+		}
+		if window <= 0 {
+			return fmt.Errorf("GEOIP_SUMMARY_WINDOW: must be positive")
+		}
+		if topK < 1 {
+			return fmt.Errorf("GEOIP_SUMMARY_TOP_K: must be at least 1")
+		}
+		s.summary = newSummary(output, window, topK)
+		go s.summaryFlusher()
+	}
+
+	// Per-endpoint records.
+	err = s.initEndpoints()
+	if err != nil {
+		return err
+	}
+
+	// Enrichment spans, off unless there's a collector to send them to.
+	if endpoint := utils.Getenv("GEOIP_OTLP_ENDPOINT", ""); endpoint != "" {
+		interval, err := getenvDuration("GEOIP_OTLP_INTERVAL",
+			5*time.Second)
+		if err != nil {
+			return err
+		}
+		if interval <= 0 {
+			return fmt.Errorf("GEOIP_OTLP_INTERVAL: must be positive")
+		}
+		s.tracer = newTracer(endpoint,
+			utils.Getenv("GEOIP_OTLP_SERVICE", "geoip"), interval,
+			s.errLog)
+	}
+
+	// HTTP control endpoint is off unless an address is given.
+	s.httpAddr = utils.Getenv("GEOIP_HTTP_ADDR", "")
+
+	// Open databases, failing on unusable optional ones if strict.  In
+	// async mode they are opened in the background instead, and lookups
+	// fail until they are ready.
+	strict, err := getenvBool("GEOIP_STRICT_OPTIONAL_DBS", false)
+	if err != nil {
+		return err
+	}
+	async, err := getenvBool("GEOIP_ASYNC_OPEN", false)
+	if err != nil {
+		return err
+	}
+	if async && strict {
+		return fmt.Errorf("GEOIP_ASYNC_OPEN: can't be used with " +
+			"GEOIP_STRICT_OPTIONAL_DBS, which needs databases open " +
+			"at startup")
+	}
+	if async {
+		go func() {
+			s.openGeoIPAsync()
+			s.startCacheFile(flushInterval)
+			s.prewarm()
+		}()
+		return nil
+	}
+	err = s.openGeoIP(strict)
+	if err != nil {
+		return err
+	}
+
+	s.startCacheFile(flushInterval)
+	s.prewarm()
+
+	return nil
+
+}
+
+// Warm the address cache from the last run, and keep the file up to date.
+func (s *work) startCacheFile(flushInterval time.Duration) {
+	if s.cache != nil && s.cacheFile != "" {
+		s.loadCache()
+		go s.cacheFlusher(flushInterval)
+	}
+}
+
+// Whether the required databases are open.  Call with the lock held.
+func (s *work) ready() bool {
+	for _, d := range s.requiredDBs() {
+		if !d.loaded() {
+			return false
+		}
+	}
+	return true
+}
+
+// Open GeoIP databases while events are being handled.  Fetching happens
+// outside the lock, which is only held while a database is swapped in.
+// Doesn't return until the required databases are open.
+func (s *work) openGeoIPAsync() {
+
+	s.reloadLock.Lock()
+	defer s.reloadLock.Unlock()
+
+	for _, d := range s.requiredDBs() {
+		d.open(&s.lock)
+	}
+
+	if s.asnDB.loaded() {
+		if counts := s.prefixCounts(s.asnDB.raw); counts != nil {
+			s.lock.Lock()
+			s.asnPrefixes = counts
+			s.lock.Unlock()
+		}
+	}
+
+	for _, d := range s.optionalDBs() {
+		d.openOptional(&s.lock)
+	}
+
+	utils.Log("GeoIP databases ready.")
+
+}
+
+// Shut down: wait for in-flight events to be sent, stopping new ones, then
+// save the cache and close the databases.  Gives up waiting after the drain
+// timeout.
+func (s *work) drain() {
+
+	utils.Log("Draining in-flight events...")
+
+	done := make(chan bool)
+	go func() {
+		s.active.Lock()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(s.drainTimeout):
+		utils.Log("Drain timed out after %s.", s.drainTimeout)
+		return
+	}
+
+	if s.cache != nil && s.cacheFile != "" {
+		err := s.saveCache()
+		if err != nil {
+			utils.Log("Couldn't write cache file: %s", err.Error())
+		}
+	}
+
+	s.lock.Lock()
+	for _, d := range append(s.requiredDBs(), s.optionalDBs()...) {
+		d.close()
+	}
+	s.lock.Unlock()
+
+	utils.Log("Drained, exiting.")
+
+}
+
+// GeoIP lookup
+func (s *work) lookup(addr string, p profile) (*place, error) {
+
+	// Convert IP address (string) to native form.
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return nil, ErrInvalidIP
+	}
+
+	// Denylisted addresses have no location, whatever the databases or
+	// overrides say.
+	if s.denied(ip) {
+		return nil, ErrNotFound
+	}
+
+	// A NAT64 address may be unknown where its IPv4 address isn't.
+	locn, err := s.lookupIP(ip, p)
+	if errorKind(err) == ErrNotFound {
+		if v4 := s.nat64.embedded(ip); v4 != nil && !s.denied(v4) {
+			return s.lookupIP(v4, p)
+		}
+	}
+	return locn, err
+
+}
+
+// Whether an address is in a denylisted range.
+func (s *work) denied(ip net.IP) bool {
+	for _, n := range s.deny {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Look up a parsed address, consulting the databases the profile needs.
+func (s *work) lookupIP(ip net.IP, p profile) (*place, error) {
+
+	// Overrides take precedence over the databases.
+	if o := s.overrides.lookup(ip); o != nil {
+		p := *o
+		return &p, nil
+	}
+
+	// Don't waste lookups on addresses which can't be in the databases.
+	if nonRoutable(ip, !s.lookupCGNAT) {
+		return nil, ErrNotFound
+	}
+
+	// The location database may not be open yet, or may be mid-swap.
+	if !s.cityDB.loaded() {
+		return nil, databaseError(errNotLoaded)
+	}
+
+	// Get data from the location database.
+	locn := &place{}
+	var ent *geoip2.Enterprise
+	var err error
+	switch {
+	case s.enterprise:
+		ent, err = s.lookupEnterprise(ip, locn, p)
+	// A Country database mounted as the City one is looked up as what it
+	// is, as City lookups on it fail.
+	case s.countryOnly || s.cityDB.country() || p&profileCity == 0:
+		err = s.lookupCountry(ip, locn)
+	default:
+		err = s.lookupCity(ip, locn)
+	}
+	if err != nil {
+		return nil, databaseError(err)
+	}
+
+	// Fall back to the country centroid, flagged as such.
+	if locn.Position == nil {
+		if c, ok := s.centroids[locn.IsoCode]; ok {
+			locn.Position = &dt.Posn{}
+			locn.Position.Latitude = c[0]
+			locn.Position.Longitude = c[1]
+			locn.PositionSource = "country"
+		}
+	}
+
+	// Country metadata.
+	if s.countryMetadata {
+		if m, ok := countryMetadata[locn.IsoCode]; ok {
+			locn.CallingCode = m.callingCode
+			locn.Currency = m.currency
+		}
+	}
+	if s.flagEmoji {
+		locn.FlagEmoji = flagEmoji(locn.IsoCode)
+	}
+	if s.alpha3 {
+		locn.IsoCode3 = alpha3Codes[locn.IsoCode]
+	}
+
+	// Lookup in ASN database.  ASN coverage lags City coverage,
+	// particularly for IPv6, so no ASN record (or an ASN error) leaves the
+	// ASN fields empty rather than discarding the City result.  So does
+	// an ASN database which isn't open.  An Enterprise record has its own.
+	// With ASNs excluded, the ASN is needed whatever the profile.
+	var asn *geoip2.ASN
+	needASN := p&profileASN != 0 || len(s.excludeASN) > 0
+	if ent != nil {
+		if needASN {
+			asn = enterpriseASN(ent)
+		}
+	} else if s.asnDB.loaded() && needASN {
+		asn, err = s.asnDB.reader.ASN(ip)
+		if err != nil {
+			s.errLog.log("ASN lookup error: %s", err.Error())
+			asn = nil
+		}
+	}
+
+	// Excluded ASNs aren't geo-tagged.
+	if asn != nil && s.excludeASN[asn.AutonomousSystemNumber] {
+		return nil, ErrNotFound
+	}
+
+	// The profile decides whether the ASN fields are filled in.
+	if p&profileASN == 0 {
+		asn = nil
+	}
+
+	if asn != nil {
+		locn.ASNum = asn.AutonomousSystemNumber
+		locn.ASOrg = asn.AutonomousSystemOrganization
+		if locn.ASOrg == "" {
+			locn.ASOrg = s.asnNames[asn.AutonomousSystemNumber]
+		}
+		locn.ASCountry = s.asnCountries[asn.AutonomousSystemNumber]
+		if s.flagCountryASN {
+			locn.CountryASNMismatch = s.countryASNMismatch(locn)
+		}
+		locn.ASNPrefixCount = s.asnPrefixes[asn.AutonomousSystemNumber]
+	}
+
+	// RIR, by ASN as that's what RIRs delegate with most certainty.
+	if s.rir != nil && p&profileASN != 0 {
+		if asn != nil {
+			locn.Rir = s.rir.lookupASN(asn.AutonomousSystemNumber)
+		}
+		if locn.Rir == "" {
+			locn.Rir = s.rir.lookupAddr(ip)
+		}
+	}
+
+	// ISP and organisation, which can differ from the ASN organisation
+	// where the ASN holder resells to other providers.
+	if ent != nil {
+		if p&profileISP != 0 {
+			locn.ISP = ent.Traits.ISP
+			locn.Organization = ent.Traits.Organization
+			locn.ConnectionType = ent.Traits.ConnectionType
+			locn.UserType = ent.Traits.UserType
+			if s.staticIPScore {
+				score := ent.Traits.StaticIPScore
+				locn.StaticIPScore = &score
+			}
+		}
+	} else if s.ispDB.loaded() && p&profileISP != 0 {
+		isp, err := s.ispDB.reader.ISP(ip)
+		if err != nil {
+			s.errLog.log("ISP lookup error: %s", err.Error())
+		} else if isp != nil {
+			locn.ISP = isp.ISP
+			locn.Organization = isp.Organization
+		}
+	}
+
+	// Anonymous-IP flags, alongside the ASN organisation.
+	if s.anonDB.loaded() && p&profileAnon != 0 {
+		anon, err := s.anonDB.reader.AnonymousIP(ip)
+		if err != nil {
+			s.errLog.log("Anonymous-IP lookup error: %s", err.Error())
+		} else if anon != nil {
+			locn.IsAnonymous = anon.IsAnonymous
+			locn.IsAnonymousVPN = anon.IsAnonymousVPN
+			locn.IsHostingProvider = anon.IsHostingProvider
+			locn.IsPublicProxy = anon.IsPublicProxy
+			locn.IsTorExitNode = anon.IsTorExitNode
+		}
+	}
+
+	// An anycast position is just one of the sites serving the address.
+	for _, n := range s.anycast {
+		if n.Contains(ip) {
+			locn.IsAnycast = true
+			if s.anycastNoPosition {
+				locn.Position = nil
+				locn.PositionSource = ""
+			}
+			break
+		}
+	}
+
+	// Don't return an empty record.
+	if locn.City == "" && locn.IsoCode == "" && locn.Country == "" &&
+		locn.Position == nil &&
+		locn.AccuracyRadius == 0 && locn.PostCode == "" &&
+		locn.ContinentCode == "" && locn.Subdivision == "" &&
+		locn.TimeZone == "" {
+		return nil, ErrNotFound
+	}
+
+	// Return the complete record.
+	return locn, nil
+
+}
+
+// Fill in the countries, with the physical or registered one as primary.
+func (s *work) setCountry(locn *place, iso, name, regIso, regName string) {
+	if s.registeredCountry {
+		locn.IsoCode = regIso
+		locn.Country = regName
+		locn.PhysicalIsoCode = iso
+		locn.PhysicalCountry = name
+	} else {
+		locn.IsoCode = iso
+		locn.Country = name
+		locn.RegisteredIsoCode = regIso
+		locn.RegisteredCountry = regName
+	}
+}
+
+// Fill in a place from the City database.
+func (s *work) lookupCity(ip net.IP, locn *place) error {
+
+	city, err := s.cityDB.reader.City(ip)
+	if err != nil {
+		return err
+	}
+
+	// If nil return, nothing to add.
+	if city == nil {
+		return nil
+	}
+
+	return s.fillCity(ip, locn, city)
+
+}
+
+// Fill in a place from a City record.
+func (s *work) fillCity(ip net.IP, locn *place, city *geoip2.City) error {
+
+	var err error
+	locn.City = s.localName(city.City.Names)
+	s.setCountry(locn, city.Country.IsoCode,
+		s.localName(city.Country.Names), city.RegisteredCountry.IsoCode,
+		s.localName(city.RegisteredCountry.Names))
+	locn.ContinentCode = city.Continent.Code
+	locn.Continent = s.localName(city.Continent.Names)
+
+	// Chosen subdivision, with its native name if that differs.
+	subIdx := s.subdivisionIndex(len(city.Subdivisions))
+	if subIdx >= 0 {
+		sub := city.Subdivisions[subIdx]
+		locn.Subdivision = s.localName(sub.Names)
+		native := nativeName(sub.Names, city.Country.IsoCode)
+		if native != locn.Subdivision {
+			locn.SubdivisionNative = native
+		}
+	}
+
+	// A 0,0 position is valid, so only a record without coordinates gets
+	// no position at all.
+	hasCoords := city.Location.Latitude != 0.0 ||
+		city.Location.Longitude != 0.0
+	if !hasCoords {
+		hasCoords, err = s.hasCoordinates(ip)
+		if err != nil {
+			return err
+		}
+	}
+	if hasCoords {
+		locn.Position = &dt.Posn{}
+		locn.Position.Latitude = city.Location.Latitude
+		locn.Position.Longitude = city.Location.Longitude
+	}
+
+	locn.AccuracyRadius = int(city.Location.AccuracyRadius)
+	locn.PostCode = city.Postal.Code
+	if s.timeZone {
+		locn.TimeZone = city.Location.TimeZone
+	}
+
+	if s.precision {
+		switch {
+		case hasCoords && locn.City != "" && locn.AccuracyRadius > 0 &&
+			locn.AccuracyRadius <= s.exactRadiusKm:
+			locn.Precision = "exact"
+		case locn.City != "":
+			locn.Precision = "city"
+		case len(city.Subdivisions) > 0:
+			locn.Precision = "region"
+		case locn.IsoCode != "":
+			locn.Precision = "country"
+		default:
+			locn.Precision = "unknown"
+		}
+	}
 
-	var waitTime = updatePeriod
+	if s.geoNameIDs {
+		locn.CityGeoNameID = city.City.GeoNameID
+		locn.CountryGeoNameID = city.Country.GeoNameID
+		if subIdx >= 0 {
+			locn.SubdivisionGeoNameID = city.Subdivisions[subIdx].GeoNameID
+		}
+	}
 
-	for {
+	return nil
 
-		// Wait appropriate sleep period.
-		time.Sleep(waitTime)
+}
+
+// Index of the subdivision to report out of n, largest first, or -1 if
+// there are none.  A record with fewer levels than the configured index
+// gives its most specific.
+func (s *work) subdivisionIndex(n int) int {
+	if s.subdivisionLevel < 0 || s.subdivisionLevel >= n {
+		return n - 1
+	}
+	return s.subdivisionLevel
+}
 
-		utils.Log("Running GeoIP update...")
+// Fill in a place from the Country database.  This only has country and
+// continent, no city or coordinates.
+func (s *work) lookupCountry(ip net.IP, locn *place) error {
 
-		// Create geoipupdate command.
-		cmd := exec.Command("geoipupdate", "-f", "GeoIP.conf",
-			"-d", ".")
+	country, err := s.cityDB.reader.Country(ip)
+	if err != nil {
+		return err
+	}
 
-		// Execute, stdout/stderr to byte array.
-		out, err := cmd.CombinedOutput()
-		if err != nil {
-			utils.Log("Update error: %s", err.Error())
-			utils.Log("geoipupdate: %s", out)
+	// If nil return, nothing to add.
+	if country == nil {
+		return nil
+	}
 
-			// Failed: Retry sooner than the long period.
-			waitTime = 60 * time.Second
-			continue
+	s.fillCountry(locn, country)
+	return nil
+
+}
 
+// Fill in a place from a Country record.
+func (s *work) fillCountry(locn *place, country *geoip2.Country) {
+
+	s.setCountry(locn, country.Country.IsoCode,
+		s.localName(country.Country.Names),
+		country.RegisteredCountry.IsoCode,
+		s.localName(country.RegisteredCountry.Names))
+	locn.ContinentCode = country.Continent.Code
+	locn.Continent = s.localName(country.Continent.Names)
+
+	if s.precision {
+		if locn.IsoCode != "" {
+			locn.Precision = "country"
+		} else {
+			locn.Precision = "unknown"
 		}
+	}
 
-		utils.Log("GeoIP updated, success.")
+	if s.geoNameIDs {
+		locn.CountryGeoNameID = country.Country.GeoNameID
+	}
 
-		// On successful update, wait period is a long period.
-		waitTime = updatePeriod
+}
 
-		// Ping the main goroutine, so it knows to reopen the
-		// GeoIP database.
-		notif <- true
+// Whether the City record for an address has coordinates.  The geoip2
+// record can't tell missing coordinates from 0,0, so this decodes just the
+// location as pointers.  Only needed when both coordinates read as zero.
+func (s *work) hasCoordinates(ip net.IP) (bool, error) {
 
+	var rec struct {
+		Location struct {
+			Latitude  *float64 `maxminddb:"latitude"`
+			Longitude *float64 `maxminddb:"longitude"`
+		} `maxminddb:"location"`
+	}
+	err := s.cityDB.raw.Lookup(ip, &rec)
+	if err != nil {
+		return false, err
 	}
 
+	return rec.Location.Latitude != nil && rec.Location.Longitude != nil,
+		nil
+
 }
 
-type work struct {
+// LookupRaw returns every field the City and ASN databases hold for an
+// address, decoded into generic maps keyed "city" and "asn".  Intended for
+// debugging and support; the event schema only carries the dt.Place subset.
+func (s *work) LookupRaw(addr string) (map[string]interface{}, error) {
+
+	// Convert IP address (string) to native form.
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return nil, ErrInvalidIP
+	}
 
-	// GeoIP City database
-	geoipCityFilename string
-	cityDB            *geoip2.Reader
+	// Readers are swapped under the lock on reload.
+	s.lock.RLock()
+	defer s.lock.RUnlock()
 
-	// GeoIP ASN database
-	geoipASNFilename string
-	asnDB            *geoip2.Reader
+	if !s.ready() {
+		return nil, databaseError(errNotLoaded)
+	}
+
+	// Decode full records.  An Enterprise record holds the ASN fields, so
+	// there's no separate one.
+	var city, asn map[string]interface{}
+	err := s.cityDB.raw.Lookup(ip, &city)
+	if err != nil {
+		return nil, databaseError(err)
+	}
+	if s.asnDB == nil {
+		return map[string]interface{}{"city": city}, nil
+	}
+	err = s.asnDB.raw.Lookup(ip, &asn)
+	if err != nil {
+		return nil, databaseError(err)
+	}
+
+	return map[string]interface{}{
+		"city": city,
+		"asn":  asn,
+	}, nil
 
-	notif chan bool
 }
 
-// Open GeoIP databases.
-func (s *work) openGeoIP() {
+// Prefixes marking IP addresses in event address lists, from
+// GEOIP_ADDR_PREFIXES.  An empty prefix accepts unprefixed addresses.
+var addrPrefixes = []string{"ipv4:", "ipv6:"}
 
-	// No errors, but doesn't return until database is open
+// Most address list entries scanned per direction, from GEOIP_MAX_ADDRS, so
+// that a pathological event can't make extraction expensive.  0 for no
+// limit.
+var maxAddrs = 16
 
-	for {
+// Get the IP address from an address list entry, and its family, "v4" or
+// "v6".  Returns an empty address if the entry isn't an IP address.
+func parseAddr(v string) (string, string) {
 
-		// Open database.
-		cityDB, err := geoip2.Open(s.geoipCityFilename)
+	for _, p := range addrPrefixes {
 
-		// If ok...
-		if err == nil {
-			// ...store database handle and return.
-			s.cityDB = cityDB
-			break
+		if !strings.HasPrefix(v, p) {
+			continue
 		}
 
-		// Open failed, wait for a while and retry.
-		utils.Log("Couldn't open GeoIP City database: %s", err.Error())
-		time.Sleep(time.Second * 10)
+		addr := v[len(p):]
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			continue
+		}
 
-		// Loop round to retry.
+		if ip.To4() != nil {
+			return addr, "v4"
+		}
+		return addr, "v6"
 
 	}
 
-	for {
+	return "", ""
 
-		// Open database.
-		asnDB, err := geoip2.Open(s.geoipASNFilename)
+}
 
-		// If ok...
-		if err == nil {
-			// ...store database handle and return.
-			s.asnDB = asnDB
-			break
+// The entries of an address list which are scanned, up to maxAddrs.
+func scannedAddrs(addrs []string) []string {
+	if maxAddrs > 0 && len(addrs) > maxAddrs {
+		return addrs[:maxAddrs]
+	}
+	return addrs
+}
+
+// Get an IP address from an event address list.
+// With preference "first" this gets the first address, and stops searching
+// once it is found.  Assumption is that outer IP address is the globally
+// addressable one for GeoIP.  With "v4" or "v6" the first address of that
+// family is used when present, otherwise the first address of any family.
+func extractAddr(addrs []string, pref string) string {
+
+	var first string
+
+	for _, v := range scannedAddrs(addrs) {
+
+		addr, family := parseAddr(v)
+		if addr == "" {
+			continue
 		}
 
-		// Open failed, wait for a while and retry.
-		utils.Log("Couldn't open GeoIP ASN database: %s", err.Error())
-		time.Sleep(time.Second * 10)
+		if pref == "first" || pref == family {
+			return addr
+		}
 
-		// Loop round to retry.
+		// Remember the first address, in case the preferred family
+		// never turns up.
+		if first == "" {
+			first = addr
+		}
 
 	}
+
+	return first
+
 }
 
-// Initialisation
-func (s *work) init(notif chan bool) error {
+// Output for an event: the one named by its route field, if that is one of
+// the configured outputs, otherwise the default.
+func (s *work) route(msg []byte) string {
 
-	s.notif = notif
+	if s.routeField == "" {
+		return defaultOutput
+	}
 
-	// Database filenames are environment variables.
-	s.geoipCityFilename = utils.Getenv("GEOIP_DB", "GeoLite2-City.mmdb")
-	s.geoipASNFilename = utils.Getenv("GEOIP_ASN_DB", "GeoLite2-ASN.mmdb")
+	var fields map[string]json.RawMessage
+	err := json.Unmarshal(msg, &fields)
+	if err != nil {
+		return defaultOutput
+	}
+
+	var out string
+	if v, ok := fields[s.routeField]; ok {
+		json.Unmarshal(v, &out)
+	}
+	if out == "" {
+		return defaultOutput
+	}
 
-	// Open databases.
-	s.openGeoIP()
+	if !s.outputs[out] {
+		s.errLog.log("Event routed to unknown output %s, using %s", out,
+			defaultOutput)
+		return defaultOutput
+	}
 
-	return nil
+	return out
 
 }
 
-// GeoIP lookup
-func (s *work) lookup(addr string) (*dt.Place, error) {
+// Where a lookup result came from.
+const (
+	fromDatabase  = "database"
+	fromCache     = "cache"
+	fromFlowCache = "flow cache"
+)
 
-	// Convert IP address (string) to native form.
-	ip := net.ParseIP(addr)
-	if ip == nil {
-		return nil, nil
+// Where each direction's location came from, empty for a direction with no
+// address.
+type lookupSources struct {
+	Src  string
+	Dest string
+}
+
+// Get location information for a source/destination address pair, which
+// isn't in the flow cache, through an address cache.  Returns nil if neither
+// address has a location.  Results go into the flow cache, so must not be
+// modified.
+func (s *work) locate(src, dest string, p profile,
+	c addrCache) (*locationInfo, lookupSources) {
+
+	// Get location information from IP addresses.
+	srcLoc, srcSource := s.resolve(src, p, c)
+	destLoc, destSource := s.resolve(dest, p, c)
+	sources := lookupSources{srcSource, destSource}
+
+	// Distance of the source from the reference point, if there is one.
+	if s.hasReference && srcLoc != nil && srcLoc.Position != nil {
+		d := haversine(s.referenceLat, s.referenceLon,
+			srcLoc.Position.Latitude, srcLoc.Position.Longitude)
+		srcLoc.DistanceFromRefKm = &d
+	}
+
+	var loc *locationInfo
+	if srcLoc != nil || destLoc != nil {
+		loc = &locationInfo{Src: srcLoc, Dest: destLoc}
+	}
+
+	// Scored from the native fields, which shaping may drop.
+	if loc != nil && s.riskWeights != nil {
+		loc.RiskScore = s.riskScore(loc)
+	}
+
+	// Final output form.
+	s.shape(srcLoc)
+	s.shape(destLoc)
+
+	if s.flowCache != nil {
+		s.flowCache.put(p.key(src+"|"+dest), loc)
+	}
+
+	return loc, sources
+
+}
+
+// Location information for a flow key from the flow cache, if it's there.
+func (s *work) flowCached(key string) (*locationInfo, bool) {
+	if s.flowCache == nil {
+		return nil, false
+	}
+	v, ok := s.flowCache.get(key)
+	if !ok {
+		return nil, false
+	}
+	return v.(*locationInfo), true
+}
+
+// Get location information for a source/destination address pair, from
+// the flow cache or by looking it up with the database lock held.  Results
+// may be shared with the flow cache, so must not be modified.
+func (s *work) locateLocked(src, dest string,
+	p profile) (*locationInfo, lookupSources) {
+
+	if loc, ok := s.flowCached(p.key(src + "|" + dest)); ok {
+		return loc, lookupSources{fromFlowCache, fromFlowCache}
+	}
+
+	c, flush := s.passCache(p, src, dest)
+	defer flush()
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.locate(src, dest, p, c)
+
+}
+
+// Lookup through an address cache, if there is one, also returning where
+// the result came from.  Returned records may be shared with the cache, so
+// must not be modified.
+func (s *work) lookupCached(addr string, p profile,
+	c addrCache) (*place, string, error) {
+
+	lookups.Add(1)
+
+	if c == nil {
+		locn, err := s.lookup(addr, p)
+		return locn, fromDatabase, err
+	}
+
+	key := p.key(addr)
+	if locn, ok := c.get(key); ok {
+		if locn == nil {
+			return nil, fromCache, ErrNotFound
+		}
+		return locn, fromCache, nil
 	}
 
-	// Lookup in GeoIP database.
-	city, err := s.cityDB.City(ip)
+	locn, err := s.lookup(addr, p)
+
+	// Misses are cached too, as nil.
+	if err == ErrNotFound {
+		c.put(key, nil)
+	}
 	if err != nil {
-		return nil, err
+		return nil, fromDatabase, err
 	}
 
-	// If nil return, give up.
-	if city == nil {
-		return nil, nil
+	c.put(key, locn)
+	return locn, fromDatabase, nil
+
+}
+
+// Get a location for one address through an address cache, as a private
+// copy the caller may modify, and where it came from.  Database errors are
+// logged, and treated as no location.
+func (s *work) resolve(addr string, p profile, c addrCache) (*place, string) {
+
+	if addr == "" {
+		return nil, ""
 	}
 
-	// Lookup in ASN database
-	asn, err := s.asnDB.ASN(ip)
+	locn, source, err := s.lookupCached(addr, p, c)
+	if err == ErrInvalidIP || err == ErrNotFound {
+		return nil, source
+	}
 	if err != nil {
-		return nil, err
+		s.errLog.log("Lookup error: %s", err.Error())
+		return nil, source
 	}
 
-	// If nil return, give up.
-	if asn == nil {
-		return nil, nil
+	cp := *locn
+	return &cp, source
+
+}
+
+// Put a place in its output form, once everything which needs the native
+// fields has used them.
+func (s *work) shape(p *place) {
+
+	if p == nil {
+		return
 	}
 
-	// Get data from GeoIP record.
-	locn := &dt.Place{}
-	locn.City = city.City.Names["en"]
-	locn.IsoCode = city.Country.IsoCode
-	locn.Country = city.Country.Names["en"]
-	locn.Position = &dt.Posn{}
-	locn.Position.Latitude = city.Location.Latitude
-	locn.Position.Longitude = city.Location.Longitude
-	locn.AccuracyRadius = int(city.Location.AccuracyRadius)
-	locn.PostCode = city.Postal.Code
-	locn.ASNum = asn.AutonomousSystemNumber
-	locn.ASOrg = asn.AutonomousSystemOrganization
+	// Hash standing in for the location, with the details kept so that the
+	// hash can be expanded.
+	if s.locationHashes != nil {
+		p.LocationHash = locationHash(p)
+		full := *p
+		s.locationHashes.put(p.LocationHash, &full)
+	}
 
-	// Don't return an empty record.
-	if locn.City == "" && locn.IsoCode == "" && locn.Country == "" &&
-		locn.Position.Latitude == 0.0 &&
-		locn.Position.Longitude == 0.0 &&
-		locn.AccuracyRadius == 0 && locn.PostCode == "" {
-		return nil, nil
+	// Accuracy radius in another unit.
+	if s.accuracyUnit != "km" && p.AccuracyRadius != 0 {
+		v := round(float64(p.AccuracyRadius)/accuracyUnits[s.accuracyUnit],
+			s.accuracyDecimals)
+		p.AccuracyRadiusValue = &v
+		p.AccuracyRadiusUnit = s.accuracyUnit
 	}
 
-	// Return the complete record.
-	return locn, nil
+	if p.Position == nil {
+		return
+	}
+
+	if s.geohashPrecision > 0 {
+		p.Geohash = geohash(p.Position.Latitude, p.Position.Longitude,
+			s.geohashPrecision)
+	}
+
+	// GeoJSON point, in addition to or instead of the flat position.
+	if s.geoJSON != "" {
+		p.GeoJSON = &geoJSONPoint{
+			Type: "Point",
+			Coordinates: [2]float64{
+				p.Position.Longitude, p.Position.Latitude,
+			},
+		}
+		if s.geoJSON == "replace" {
+			p.Position = nil
+		}
+	}
+
+}
+
+// Partition key for an event's location: the configured attribute of the
+// source location, or the destination if the source has none.
+func (s *work) partitionKey(loc *locationInfo) string {
+
+	if s.partitionBy == "" {
+		return ""
+	}
+
+	for _, p := range []*place{loc.Src, loc.Dest} {
+		if p == nil {
+			continue
+		}
+		switch s.partitionBy {
+		case "iso":
+			if p.IsoCode != "" {
+				return p.IsoCode
+			}
+		case "asn":
+			if p.ASNum != 0 {
+				return strconv.FormatUint(uint64(p.ASNum), 10)
+			}
+		}
+	}
+
+	return ""
 
 }
 
 // Event handler for new events.
-func (h *work) Handle(msg []uint8, w *worker.Worker) error {
+func (h *work) Handle(msg []uint8, w *worker.Worker) (err error) {
+
+	// Blocks once shutdown has started.
+	h.active.RLock()
+	defer h.active.RUnlock()
+
+	// A panic fails just this event.
+	defer func() {
+		if r := recover(); r != nil {
+			panics.Add(1)
+			h.errLog.log("Panic handling event: %v: %s", r,
+				truncate(msg, maxLoggedMessage))
+			err = h.failed(w, msg, fmt.Errorf("panic: %v", r))
+		}
+	}()
 
 	// If there's a signal from the GeoIP database updater, re-open the
 	// database.
 	select {
 	case _ = <-h.notif:
-		utils.Log("An update occured - reopening database.")
-		h.openGeoIP()
+		utils.Log("An update occured - reopening changed databases.")
+		h.reloadGeoIP()
 
 	default:
 		// No signal, do nothing.
 
 	}
 
+	// Check size before decoding, to protect against huge payloads.
+	if h.maxMessageSize > 0 && len(msg) > h.maxMessageSize {
+		oversizeMessages.Add(1)
+		// Not wrapped by the formatter, as that would decode it.
+		if h.forwardOversize {
+			h.errLog.log("Forwarding oversize messages unchanged")
+			h.send(w, defaultOutput, msg)
+		} else {
+			h.errLog.log("Dropping oversize messages")
+		}
+		return nil
+	}
+
+	// Per-message output, if routing is configured.
+	out := h.route(msg)
+
+	// Under sampling, events outside the sample go through un-enriched.
+	sampled := h.sampleRate < 1.0
+	if sampled && rand.Float64() >= h.sampleRate {
+		return h.passThrough(w, out, msg)
+	}
+
+	// Under backpressure, shed enrichment or slow down.
+	if h.backpressure != nil {
+		shed, delay := h.backpressure.state()
+		if shed {
+			shedEvents.Add(1)
+			return h.passThrough(w, out, msg)
+		}
+		time.Sleep(delay)
+	}
+
 	// Read event, decode JSON.
-	var event dt.Event
-	err := json.Unmarshal(msg, &event)
+	var event event
+	err = json.Unmarshal(msg, &event)
 	if err != nil {
-		utils.Log("Couldn't unmarshal json: %s", err.Error())
+		malformedMessages.Add(1)
+		h.errLog.log("Couldn't unmarshal json: %s", err.Error())
 		return nil
 	}
 
@@ -234,58 +2050,174 @@ func (h *work) Handle(msg []uint8, w *worker.Worker) error {
 		utils.Log("%s", string(msg))
 	}
 
-	var src, dest string
+	// Get source and destination IP addresses.
+	if maxAddrs > 0 && (len(event.Src) > maxAddrs ||
+		len(event.Dest) > maxAddrs) {
+		h.errLog.log("Event from %s has over %d addresses in a direction, "+
+			"only the first %d are scanned", event.Device, maxAddrs,
+			maxAddrs)
+	}
+	src := extractAddr(event.Src, h.srcFamilyPref)
+	dest := extractAddr(event.Dest, h.destFamilyPref)
+	if h.destService {
+		event.DestService = destService(event.Dest)
+	}
+	prof := h.profileFor(event.Action)
 
-	// Get source IP address.
-	// This gets the first address, and searches once it is found.
-	// Assumption is that outer IP address is the globally addressable one
-	// for GeoIP.
-	for _, v := range event.Src {
-		if strings.HasPrefix(v, "ipv4:") || strings.HasPrefix(v, "ipv6:") {
-			src = v[5:]
-			break
+	// Audit trail, if this event is audited.
+	var audit *auditRecord
+	if h.audit != nil && h.audit.sample() {
+		audit = h.startAudit(&event, src, dest)
+	}
+
+	// Nothing to look up, so the original message needn't be re-encoded,
+	// unless it has been tagged.
+	if src == "" && dest == "" {
+		noAddressMessages.Add(1)
+		if audit != nil {
+			h.logAudit(audit, nil, lookupSources{})
+		}
+		event.Sampled = sampled
+		body := msg
+		if event.Sampled || event.DestService != "" {
+			body, err = json.Marshal(event)
+			if err != nil {
+				return h.failed(w, msg, fmt.Errorf("JSON marshal error: %s",
+					err.Error()))
+			}
+		}
+		j, err := h.formatter.format(&event, body)
+		if err != nil {
+			h.errLog.log("Output format error: %s", err.Error())
+			return nil
 		}
+		h.send(w, out, j)
+		return nil
 	}
 
-	// Get destination IP address.
-	// This gets the first address, and searches once it is found.
-	// Assumption is that outer IP address is the globally addressable one
-	// for GeoIP.
-	for _, v := range event.Dest {
-		if strings.HasPrefix(v, "ipv4:") || strings.HasPrefix(v, "ipv6:") {
-			dest = v[5:]
-			break
+	// Get location information from IP addresses, and store it in the
+	// event record if there is any.
+	start := time.Now()
+	loc, sources := h.locateLocked(src, dest, prof)
+	countSources(sources)
+	if h.tracer != nil {
+		h.tracer.enriched(event.TraceParent, start, time.Now(), loc,
+			sources)
+	}
+	if loc != nil && h.asnCountries != nil {
+		h.checkCountryASN(loc)
+	}
+	if loc != nil && h.dualStack {
+		loc = h.withFamilies(loc, event.Src, event.Dest, prof)
+	}
+	if loc != nil && h.stampTime {
+
+		// Shared with the flow cache, so stamp a copy.
+		stamped := *loc
+		stamped.EnrichedAt = time.Now().UTC().Format(time.RFC3339)
+		loc = &stamped
+
+	}
+	if loc != nil && h.utcOffset {
+		loc = withOffsets(loc, eventTime(event.Time))
+	}
+	if loc != nil && h.mergeLocation {
+		loc = mergeLocation(event.Location, loc)
+	}
+	if loc != nil {
+		event.Location = loc
+		event.PartitionKey = h.partitionKey(loc)
+		if h.emitBoth {
+			event.flat = flatten(loc)
 		}
 	}
 
-	// Get location information from IP addresses.
-	srcLoc, _ := h.lookup(src)
-	destLoc, _ := h.lookup(dest)
+	// Mark events which were in the sample.
+	event.Sampled = sampled
 
-	// If we get either a source or destination location, store the
-	// information in the event record.
-	if srcLoc != nil || destLoc != nil {
-		event.Location = &dt.LocationInfo{}
-		event.Location.Src = srcLoc
-		event.Location.Dest = destLoc
+	if audit != nil {
+		h.logAudit(audit, loc, sources)
+	}
+
+	// Windowed counts.
+	if h.summary != nil {
+		h.summarise(w, loc)
+	}
+
+	// Flag test or garbage traffic.
+	if h.tagReserved {
+		for _, a := range []string{src, dest} {
+			if ip := net.ParseIP(a); ip != nil && reserved(ip) {
+				event.IsReserved = true
+			}
+		}
+	}
+
+	// Per-endpoint records instead of the event.
+	if h.endpointMode == "only" {
+		h.sendEndpoints(w, out, &event, src, dest, loc)
+		return nil
 	}
 
 	// Convert event record back to JSON.
 	j, err := json.Marshal(event)
 	if err != nil {
-		utils.Log("JSON marshal error: %s", err.Error())
-		return nil
+		return h.failed(w, msg, fmt.Errorf("JSON marshal error: %s",
+			err.Error()))
+	}
+
+	// Wrap for output.
+	j, err = h.formatter.format(&event, j)
+	if err != nil {
+		return h.failed(w, msg, fmt.Errorf("output format error: %s",
+			err.Error()))
 	}
 
 	// Forward event record to output queue.
-	w.Send("output", j)
+	h.send(w, out, j)
+
+	// Per-endpoint records after it.
+	if h.endpointMode == "also" {
+		h.sendEndpoints(w, out, &event, src, dest, loc)
+	}
 
 	return nil
 
 }
 
 func main() {
-	utils.LogPgm = pgm
+
+	// Command line: [flags] input[,input...] [output...]
+	name := flag.String("name", utils.Getenv("GEOIP_NAME", pgm),
+		"program name for logs and metrics")
+	updateOnly := flag.Bool("update-only", false,
+		"run geoipupdate once and exit")
+	replay := flag.String("replay", "",
+		"file of events to run through the worker, without queues")
+	replayOutput := flag.String("replay-output", "",
+		"file for replayed events, default stdout")
+	flag.Parse()
+	args := flag.Args()
+
+	utils.LogPgm = *name
+
+	err := initUpdate()
+	if err != nil {
+		utils.Log("init: %s", err.Error())
+		return
+	}
+
+	// One-shot update, e.g. to prime a database volume.
+	if *updateOnly {
+		out, err := runUpdate()
+		if err != nil {
+			utils.Log("Update error: %s", err.Error())
+			utils.Log("geoipupdate: %s", out)
+			os.Exit(1)
+		}
+		utils.Log("GeoIP updated, success.")
+		return
+	}
 
 	// Notification channel.  A bool gets sent down the channel every time
 	// the updater goroutine inovkes an update.
@@ -294,25 +2226,31 @@ func main() {
 	// Launch updater goroutine
 	go updater(notif)
 
-	var w worker.QueueWorker
 	var s work
 
 	// Initialise.
-	err := s.init(notif)
+	err = s.init(notif)
 	if err != nil {
 		utils.Log("init: %s", err.Error())
 		return
 	}
 
+	utils.Log("Configuration: %s", s.describe())
+
+	// Start HTTP control endpoint.
+	if s.httpAddr != "" {
+		go s.serveHTTP()
+	}
+
 	// Initialise.
-	var input string
+	inputs := []string{""}
 	var output []string
 
-	if len(os.Args) > 0 {
-		input = os.Args[1]
+	if len(args) > 0 {
+		inputs = strings.Split(args[0], ",")
 	}
-	if len(os.Args) > 2 {
-		output = os.Args[2:]
+	if len(args) > 1 {
+		output = args[1:]
 	}
 
 	// context to handle control of subroutines
@@ -320,17 +2258,104 @@ func main() {
 	ctx, cancel := utils.ContextWithSigterm(ctx)
 	defer cancel()
 
-	err = w.Initialise(ctx, input, output, pgm)
-	if err != nil {
-		utils.Log("init: %s", err.Error())
+	// Outputs an event may be routed to, by name: the part before any ":"
+	// in the output argument.
+	s.outputs = map[string]bool{}
+	for _, o := range output {
+		s.outputs[strings.SplitN(o, ":", 2)[0]] = true
+	}
+
+	// Replay a file, with no queue worker.
+	if *replay != "" {
+		s.localOut = os.Stdout
+		if *replayOutput != "" {
+			f, err := os.Create(*replayOutput)
+			if err != nil {
+				utils.Log("init: %s", err.Error())
+				return
+			}
+			defer f.Close()
+			s.localOut = f
+		}
+		f, err := os.Open(*replay)
+		if err != nil {
+			utils.Log("init: %s", err.Error())
+			return
+		}
+		defer f.Close()
+		utils.Log("Initialisation complete, replaying %s.", *replay)
+		err = s.runLocal(ctx, f)
+		if err != nil {
+			utils.Log("error: replay: %s", err.Error())
+		}
+		s.drain()
+		return
+	}
+
+	// Input "-" is stdin, with no queue worker, so output is stdout too.
+	if len(inputs) == 1 && inputs[0] == "-" {
+		s.localOut = os.Stdout
+		utils.Log("Initialisation complete, reading stdin.")
+		err = s.runLocal(ctx, os.Stdin)
+		if err != nil {
+			utils.Log("error: stdin: %s", err.Error())
+		}
+		s.drain()
 		return
 	}
 
+	// Output "-" is stdout.
+	if len(output) == 1 && output[0] == "-" {
+		s.localOut = os.Stdout
+		output = nil
+	}
+
+	if s.localOut == nil && s.deadLetterOutput != "" &&
+		!s.outputs[s.deadLetterOutput] {
+		utils.Log("init: dead-letter output %s isn't an output",
+			s.deadLetterOutput)
+		return
+	}
+	if s.localOut == nil && s.summary != nil &&
+		!s.outputs[s.summary.output] {
+		utils.Log("init: summary output %s isn't an output",
+			s.summary.output)
+		return
+	}
+	if s.localOut == nil && s.endpointOutput != "" &&
+		!s.outputs[s.endpointOutput] {
+		utils.Log("init: endpoint output %s isn't an output",
+			s.endpointOutput)
+		return
+	}
+
+	// One queue worker per input, all with the same handler and outputs.
+	workers := make([]worker.QueueWorker, len(inputs))
+	for i, input := range inputs {
+		err = workers[i].Initialise(ctx, input, output, *name)
+		if err != nil {
+			utils.Log("init: %s: %s", input, err.Error())
+			return
+		}
+	}
+
 	utils.Log("Initialisation complete.")
 
 	// Invoke Wye event handling.
-	err = w.Run(ctx, &s)
-	if err != nil {
-		utils.Log("error: Event handling failed with err: %s", err.Error())
+	var wg sync.WaitGroup
+	for i := range workers {
+		wg.Add(1)
+		go func(w *worker.QueueWorker, input string) {
+			defer wg.Done()
+			err := w.Run(ctx, &s)
+			if err != nil {
+				utils.Log("error: Event handling failed on %s with "+
+					"err: %s", input, err.Error())
+			}
+		}(&workers[i], inputs[i])
 	}
+	wg.Wait()
+
+	s.drain()
+
 }
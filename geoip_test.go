@@ -0,0 +1,414 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// One lookup fills in the ASN organisation and the Anonymous-IP flags.
+func TestLookupASNAndAnonymousIP(t *testing.T) {
+
+	dir, cleanup := testDir(t)
+	defer cleanup()
+
+	s, closeDBs := testWork(t, map[string]string{
+		"GEOIP_DB": testDB(t, dir, "city.mmdb", "GeoLite2-City", 1,
+			[]testNetwork{
+				{"1.2.3.0/24", testCityRecord("US", "United States", "")},
+				{"5.6.7.0/24", testCityRecord("NL", "Netherlands", "")},
+			}),
+		"GEOIP_ASN_DB": testDB(t, dir, "asn.mmdb", "GeoLite2-ASN", 1,
+			[]testNetwork{
+				{"1.2.3.0/24", testASNRecord(64500, "Example Hosting")},
+				{"5.6.7.0/24", testASNRecord(64501, "Example Broadband")},
+			}),
+		"GEOIP_ANON_DB": testDB(t, dir, "anon.mmdb", "GeoIP2-Anonymous-IP",
+			1, []testNetwork{
+				{"1.2.3.0/24", map[string]interface{}{
+					"is_anonymous":        true,
+					"is_anonymous_vpn":    true,
+					"is_hosting_provider": true,
+				}},
+			}),
+	})
+	defer closeDBs()
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	locn, err := s.lookup("1.2.3.4", s.defaultProfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if locn.ASNum != 64500 || locn.ASOrg != "Example Hosting" {
+		t.Errorf("ASN %d %q", locn.ASNum, locn.ASOrg)
+	}
+	if !locn.IsHostingProvider || !locn.IsAnonymous || !locn.IsAnonymousVPN {
+		t.Errorf("flags: hosting %v, anonymous %v, VPN %v",
+			locn.IsHostingProvider, locn.IsAnonymous, locn.IsAnonymousVPN)
+	}
+	if locn.IsPublicProxy || locn.IsTorExitNode {
+		t.Errorf("unexpected flags: proxy %v, Tor %v", locn.IsPublicProxy,
+			locn.IsTorExitNode)
+	}
+
+	// Not in the Anonymous-IP database: no flags, ASN still there.
+	locn, err = s.lookup("5.6.7.8", s.defaultProfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if locn.ASOrg != "Example Broadband" || locn.IsHostingProvider ||
+		locn.IsAnonymous {
+		t.Errorf("got ASN %q, hosting %v, anonymous %v", locn.ASOrg,
+			locn.IsHostingProvider, locn.IsAnonymous)
+	}
+
+}
+
+// Address extraction: position, family preference, and entries which aren't
+// addresses.
+func TestExtractAddr(t *testing.T) {
+
+	oldPrefixes, oldMax := addrPrefixes, maxAddrs
+	addrPrefixes, maxAddrs = []string{"ipv4:", "ipv6:"}, 4
+	defer func() { addrPrefixes, maxAddrs = oldPrefixes, oldMax }()
+
+	for _, c := range []struct {
+		name  string
+		addrs []string
+		pref  string
+		want  string
+	}{
+		{"first wins", []string{"ipv4:10.0.0.1", "ipv4:1.2.3.4"},
+			"first", "10.0.0.1"},
+		{"first of any family", []string{"ipv6:2001:db8::1",
+			"ipv4:1.2.3.4"}, "first", "2001:db8::1"},
+		{"preferred v4", []string{"ipv6:2001:db8::1", "ipv4:1.2.3.4"},
+			"v4", "1.2.3.4"},
+		{"preferred v6", []string{"ipv4:1.2.3.4", "ipv6:2001:db8::1"},
+			"v6", "2001:db8::1"},
+		{"preferred family missing", []string{"ipv4:1.2.3.4",
+			"ipv4:5.6.7.8"}, "v6", "1.2.3.4"},
+		{"ports and protocols skipped", []string{"mac:00:11:22:33:44:55",
+			"tcp:443", "ipv4:1.2.3.4"}, "first", "1.2.3.4"},
+		{"empty and garbage skipped", []string{"", "ipv4:", "ipv4:nonsense",
+			"ipv6:fc00::1"}, "first", "fc00::1"},
+		{"nothing but garbage", []string{"", "ipv4:", "garbage"}, "first",
+			""},
+		{"unprefixed not accepted", []string{"1.2.3.4"}, "first", ""},
+		{"wrong prefix for family", []string{"ipv6:1.2.3.4"}, "v4",
+			"1.2.3.4"},
+		{"beyond the address limit", []string{"tcp:1", "tcp:2", "tcp:3",
+			"tcp:4", "ipv4:1.2.3.4"}, "first", ""},
+		{"no addresses", nil, "first", ""},
+	} {
+		got := extractAddr(c.addrs, c.pref)
+		if got != c.want {
+			t.Errorf("%s: got %q, expected %q", c.name, got, c.want)
+		}
+	}
+
+}
+
+// Events outside the sample, events with nothing to look up, and events
+// shed under backpressure go through the output formatter like enriched
+// ones, with their tags.  Forwarded oversize messages don't.
+func TestPassThroughFormatted(t *testing.T) {
+
+	dir, cleanup := testDir(t)
+	defer cleanup()
+
+	env := testDBEnv(t, dir)
+	env["GEOIP_SAMPLE_RATE"] = "0"
+	env["GEOIP_OUTPUT_FORMAT"] = "cloudevents"
+	env["GEOIP_DEST_SERVICE"] = "true"
+	s, closeDBs := testWork(t, env)
+	defer closeDBs()
+
+	var ce cloudEvent
+	out := testHandle(t, s, `{"id":"e1","src":["ipv4:1.2.3.4"]}`)
+	err := json.Unmarshal(out, &ce)
+	if err != nil || ce.ID != "e1" {
+		t.Fatalf("sampled-out event not wrapped: %s", out)
+	}
+	if string(ce.Data) != `{"id":"e1","src":["ipv4:1.2.3.4"]}` {
+		t.Errorf("sampled-out event changed: %s", ce.Data)
+	}
+
+	// In the sample, without addresses to look up.
+	s.sampleRate = 0.999999999
+	out = testHandle(t, s, `{"id":"e2","dest":["tcp:443"]}`)
+	err = json.Unmarshal(out, &ce)
+	if err != nil || ce.ID != "e2" {
+		t.Fatalf("event not wrapped: %s", out)
+	}
+	var ev struct {
+		Sampled     bool   `json:"geoip_sampled"`
+		DestService string `json:"dest_service"`
+	}
+	err = json.Unmarshal(ce.Data, &ev)
+	if err != nil || !ev.Sampled || ev.DestService != "https" {
+		t.Errorf("tags missing: %s", ce.Data)
+	}
+
+	// Shed under backpressure.
+	s.sampleRate = 1.0
+	s.backpressure = &backpressure{shed: true, engaged: true}
+	out = testHandle(t, s, `{"id":"e3","src":["ipv4:1.2.3.4"]}`)
+	err = json.Unmarshal(out, &ce)
+	if err != nil || ce.ID != "e3" {
+		t.Fatalf("shed event not wrapped: %s", out)
+	}
+	s.backpressure = nil
+
+	// Forwarded oversize, as it came.
+	s.maxMessageSize, s.forwardOversize = 10, true
+	msg := `{"id":"e4","src":["ipv4:1.2.3.4"]}`
+	out = testHandle(t, s, msg)
+	if string(out) != msg {
+		t.Errorf("oversize message changed: %s", out)
+	}
+
+}
+
+// The ASN holder and the reselling ISP are kept apart.
+func TestLookupResellerISP(t *testing.T) {
+
+	dir, cleanup := testDir(t)
+	defer cleanup()
+
+	env := testDBEnv(t, dir)
+	env["GEOIP_ISP_DB"] = testDB(t, dir, "isp.mmdb", "GeoIP2-ISP", 1,
+		[]testNetwork{
+			{"1.2.3.0/24", map[string]interface{}{
+				"autonomous_system_number":       uint(64500),
+				"autonomous_system_organization": "Example Net",
+				"isp":                            "Reseller Broadband",
+				"organization":                   "Example Customer Ltd",
+			}},
+		})
+	s, closeDBs := testWork(t, env)
+	defer closeDBs()
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	locn, err := s.lookup("1.2.3.4", s.defaultProfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if locn.ASOrg != "Example Net" {
+		t.Errorf("ASN organisation %q", locn.ASOrg)
+	}
+	if locn.ISP != "Reseller Broadband" {
+		t.Errorf("ISP %q", locn.ISP)
+	}
+	if locn.Organization != "Example Customer Ltd" {
+		t.Errorf("organisation %q", locn.Organization)
+	}
+
+}
+
+// Lookups with databases which aren't there, or aren't open, fail with a
+// database error rather than panicking.  A missing ASN database only
+// leaves the ASN fields empty.
+func TestLookupNilDatabases(t *testing.T) {
+
+	s := &work{errLog: newRateLog(time.Minute)}
+	for _, c := range []struct {
+		name string
+		city *database
+		asn  *database
+	}{
+		{"no databases", nil, nil},
+		{"unopened databases", newDatabase("City", "none.mmdb", nil),
+			newDatabase("ASN", "none.mmdb", nil)},
+	} {
+		s.cityDB, s.asnDB = c.city, c.asn
+		_, err := s.lookup("1.2.3.4", fullProfile)
+		if errorKind(err) != ErrDatabase {
+			t.Errorf("%s: lookup error %v, expected a database error",
+				c.name, err)
+		}
+		_, err = s.LookupRaw("1.2.3.4")
+		if errorKind(err) != ErrDatabase {
+			t.Errorf("%s: LookupRaw error %v, expected a database error",
+				c.name, err)
+		}
+	}
+
+	dir, cleanup := testDir(t)
+	defer cleanup()
+
+	s, closeDBs := testWork(t, testDBEnv(t, dir))
+	defer closeDBs()
+
+	for _, asn := range []*database{nil,
+		newDatabase("ASN", "none.mmdb", nil)} {
+		saved := s.asnDB
+		s.asnDB = asn
+		locn, err := s.lookup("1.2.3.4", s.defaultProfile)
+		s.asnDB = saved
+		if err != nil {
+			t.Fatal(err)
+		}
+		if locn.City != "London" || locn.ASNum != 0 || locn.ASOrg != "" {
+			t.Errorf("without ASN database: got %+v", locn)
+		}
+	}
+
+}
+
+// A record with any one location field is returned, and one with none, or
+// only network fields, isn't.
+func TestLookupEmptyRecord(t *testing.T) {
+
+	dir, cleanup := testDir(t)
+	defer cleanup()
+
+	cases := []struct {
+		name   string
+		record map[string]interface{}
+		found  bool
+	}{
+		{"city", map[string]interface{}{
+			"city": map[string]interface{}{
+				"names": map[string]string{"en": "London"},
+			},
+		}, true},
+		{"country code", map[string]interface{}{
+			"country": map[string]interface{}{"iso_code": "GB"},
+		}, true},
+		{"country name", map[string]interface{}{
+			"country": map[string]interface{}{
+				"names": map[string]string{"en": "United Kingdom"},
+			},
+		}, true},
+		{"position", map[string]interface{}{
+			"location": map[string]interface{}{
+				"latitude": 51.5, "longitude": -0.1,
+			},
+		}, true},
+		{"zero position", map[string]interface{}{
+			"location": map[string]interface{}{
+				"latitude": 0.0, "longitude": 0.0,
+			},
+		}, true},
+		{"accuracy radius", map[string]interface{}{
+			"location": map[string]interface{}{
+				"accuracy_radius": uint16(100),
+			},
+		}, true},
+		{"postal code", map[string]interface{}{
+			"postal": map[string]interface{}{"code": "SW1A"},
+		}, true},
+		{"continent", map[string]interface{}{
+			"continent": map[string]interface{}{"code": "EU"},
+		}, true},
+		{"subdivision", map[string]interface{}{
+			"subdivisions": []interface{}{
+				map[string]interface{}{
+					"names": map[string]string{"en": "England"},
+				},
+			},
+		}, true},
+		{"time zone", map[string]interface{}{
+			"location": map[string]interface{}{
+				"time_zone": "Europe/London",
+			},
+		}, true},
+		{"no position", map[string]interface{}{
+			"location": map[string]interface{}{},
+		}, false},
+		{"empty", map[string]interface{}{}, false},
+	}
+
+	var city, asn []testNetwork
+	for i, c := range cases {
+		cidr := fmt.Sprintf("1.2.%d.0/24", i)
+		city = append(city, testNetwork{cidr, c.record})
+		asn = append(asn, testNetwork{cidr, testASNRecord(64500, "Net")})
+	}
+
+	s, closeDBs := testWork(t, map[string]string{
+		"GEOIP_DB": testDB(t, dir, "city.mmdb", "GeoLite2-City", 1,
+			city),
+		"GEOIP_ASN_DB": testDB(t, dir, "asn.mmdb", "GeoLite2-ASN", 1,
+			asn),
+		"GEOIP_TIME_ZONE": "true",
+	})
+	defer closeDBs()
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	for i, c := range cases {
+		locn, err := s.lookup(fmt.Sprintf("1.2.%d.1", i),
+			s.defaultProfile)
+		switch {
+		case c.found && err != nil:
+			t.Errorf("%s: %v", c.name, err)
+		case !c.found && err != ErrNotFound:
+			t.Errorf("%s: got %+v, %v, expected not found", c.name, locn,
+				err)
+		}
+	}
+
+}
+
+// Excluded ASNs aren't geo-tagged under a profile without the ASN fields,
+// which are still left out for other addresses.
+func TestExcludeASNWithoutASNProfile(t *testing.T) {
+
+	dir, cleanup := testDir(t)
+	defer cleanup()
+
+	env := testDBEnv(t, dir)
+	env["GEOIP_EXCLUDE_ASN"] = "AS64500"
+	s, closeDBs := testWork(t, env)
+	defer closeDBs()
+
+	p, err := parseProfile("country")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	_, err = s.lookup("1.2.3.4", p)
+	if err != ErrNotFound {
+		t.Errorf("excluded ASN: got %v", err)
+	}
+	locn, err := s.lookup("2001:4860::1", p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if locn.ASNum != 0 || locn.ASOrg != "" {
+		t.Errorf("ASN fields outside the profile: %d %q", locn.ASNum,
+			locn.ASOrg)
+	}
+
+}
+
+// Strict optional databases need them open at startup, so can't be
+// combined with opening in the background.
+func TestAsyncOpenStrict(t *testing.T) {
+
+	dir, cleanup := testDir(t)
+	defer cleanup()
+
+	env := testDBEnv(t, dir)
+	env["GEOIP_ASYNC_OPEN"] = "true"
+	env["GEOIP_STRICT_OPTIONAL_DBS"] = "true"
+	defer setTestEnv(env)()
+
+	s := &work{}
+	err := s.init(make(chan bool, 2))
+	if err == nil {
+		t.Errorf("async open with strict optional databases was accepted")
+	}
+
+}
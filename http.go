@@ -0,0 +1,167 @@
+//
+// HTTP control endpoint.  Enabled by setting GEOIP_HTTP_ADDR to a listen
+// address, e.g. ":8081".
+//
+//   POST /update      Run geoipupdate now, or wait for the update already
+//                     running, and reopen the databases if it succeeds.
+//                     Returns the geoipupdate output.
+//   GET /lookup?ip=   Location of an address, as JSON.  400 for an invalid
+//                     address, 404 if there is no location, 500 for a
+//                     database error.
+//   GET /location?hash=
+//                     Location behind a location hash, as JSON, if it has
+//                     been seen since startup.  404 if not.
+//   GET /ready        200 once the databases are open, 503 before.
+//   GET /debug/vars   Counters, in expvar JSON form.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http"
+
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+// Goroutine: HTTP server.
+func (s *work) serveHTTP() {
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/update", s.handleUpdate)
+	mux.HandleFunc("/lookup", s.handleLookup)
+	mux.HandleFunc("/ready", s.handleReady)
+	mux.HandleFunc("/location", s.handleLocation)
+	mux.Handle("/debug/vars", expvar.Handler())
+
+	utils.Log("HTTP control endpoint on %s", s.httpAddr)
+
+	err := http.ListenAndServe(s.httpAddr, mux)
+	if err != nil {
+		utils.Log("HTTP server: %s", err.Error())
+	}
+
+}
+
+// Handler for /update: runs an immediate database update.
+func (s *work) handleUpdate(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	out, err := runUpdate()
+
+	w.Header().Set("Content-Type", "text/plain")
+
+	if err == errUpdateTimeout {
+		utils.Log("Update timed out after %s, killed geoipupdate.",
+			updateTimeout)
+		w.WriteHeader(http.StatusGatewayTimeout)
+		w.Write([]byte("update timed out\n"))
+		w.Write(out)
+		return
+	}
+
+	if err != nil {
+		utils.Log("Update error: %s", err.Error())
+		utils.Log("geoipupdate: %s", out)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("update failed: " + err.Error() + "\n"))
+		w.Write(out)
+		return
+	}
+
+	utils.Log("GeoIP updated on request, success.")
+
+	// Have the event handler reopen the databases.
+	notify(s.notif)
+
+	w.Write(out)
+
+}
+
+// Handler for /lookup: looks up a single address.
+func (s *work) handleLookup(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.lock.RLock()
+	locn, err := s.lookup(r.URL.Query().Get("ip"), fullProfile)
+	s.lock.RUnlock()
+
+	switch errorKind(err) {
+	case nil:
+	case ErrInvalidIP:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case ErrNotFound:
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	default:
+		utils.Log("Lookup error: %s", err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	j, err := json.Marshal(locn)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(j)
+
+}
+
+// Handler for /ready: readiness probe.
+func (s *work) handleReady(w http.ResponseWriter, r *http.Request) {
+
+	s.lock.RLock()
+	ready := s.ready()
+	s.lock.RUnlock()
+
+	if !ready {
+		http.Error(w, "databases not open", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Write([]byte("ready\n"))
+
+}
+
+// Handler for /location: expands a location hash.
+func (s *work) handleLocation(w http.ResponseWriter, r *http.Request) {
+
+	if s.locationHashes == nil {
+		http.Error(w, "location hashes not enabled", http.StatusNotFound)
+		return
+	}
+
+	v, ok := s.locationHashes.get(r.URL.Query().Get("hash"))
+	if !ok {
+		http.Error(w, "unknown location hash", http.StatusNotFound)
+		return
+	}
+
+	// Without the hash, so that the details are output.
+	p := *v.(*place)
+	p.LocationHash = ""
+	j, err := json.Marshal(&p)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(j)
+
+}
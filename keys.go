@@ -0,0 +1,242 @@
+//
+// Output key remapping for location objects.  Some consumers expect a
+// particular key style (e.g. snake_case) which doesn't match the struct
+// tags on the shared location types.  GEOIP_KEY_STYLE converts every Go
+// field name to a style ("snake" or "camel"), and GEOIP_KEY_MAP gives
+// explicit Go field to key mappings, e.g. "IsoCode=iso_code,ASNum=asn".
+// Explicit mappings win over the style.
+//
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"unicode"
+
+	dt "github.com/trustnetworks/analytics-common/datatypes"
+)
+
+// Replacement output key, keyed by the key the field is normally
+// serialised with.  Nil when no remapping is configured.
+var keyRemap map[string]string
+
+// Build keyRemap from a style and a Go field to key mapping table.
+func initKeyRemap(style, table string) error {
+
+	if style != "" && style != "snake" && style != "camel" {
+		return fmt.Errorf("GEOIP_KEY_STYLE: unknown style: %s", style)
+	}
+
+	// Parse explicit mappings.
+	explicit := map[string]string{}
+	for _, v := range strings.Split(table, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		kv := strings.SplitN(v, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return fmt.Errorf("GEOIP_KEY_MAP: bad mapping: %s", v)
+		}
+		explicit[kv[0]] = kv[1]
+	}
+
+	if style == "" && len(explicit) == 0 {
+		keyRemap = nil
+		return nil
+	}
+
+	// Walk the fields of every type which appears in a location object.
+	remap := map[string]string{}
+	addFieldKeys(remap, reflect.TypeOf(place{}), style, explicit)
+	addFieldKeys(remap, reflect.TypeOf(dt.Posn{}), style, explicit)
+
+	// Catch typos in the mapping table.
+	for k := range explicit {
+		if !hasField(reflect.TypeOf(place{}), k) &&
+			!hasField(reflect.TypeOf(dt.Posn{}), k) {
+			return fmt.Errorf("GEOIP_KEY_MAP: unknown field: %s", k)
+		}
+	}
+
+	keyRemap = remap
+	return nil
+
+}
+
+// Whether a struct type has a field, including promoted fields.
+func hasField(t reflect.Type, name string) bool {
+	_, ok := t.FieldByName(name)
+	return ok
+}
+
+// Add key mappings for the fields of a struct type, descending into
+// embedded structs whose fields are promoted into the same JSON object.
+func addFieldKeys(remap map[string]string, t reflect.Type, style string,
+	explicit map[string]string) {
+
+	for i := 0; i < t.NumField(); i++ {
+
+		f := t.Field(i)
+
+		// Normal key, from the JSON tag.
+		tag := strings.Split(f.Tag.Get("json"), ",")[0]
+		if tag == "-" {
+			continue
+		}
+
+		if f.Anonymous && tag == "" && f.Type.Kind() == reflect.Struct {
+			addFieldKeys(remap, f.Type, style, explicit)
+			continue
+		}
+
+		if f.PkgPath != "" {
+			continue
+		}
+
+		key := tag
+		if key == "" {
+			key = f.Name
+		}
+
+		out := key
+		switch style {
+		case "snake":
+			out = strings.Join(splitWords(f.Name), "_")
+		case "camel":
+			words := splitWords(f.Name)
+			for i := 1; i < len(words); i++ {
+				words[i] = strings.Title(words[i])
+			}
+			out = strings.Join(words, "")
+		}
+		if v, ok := explicit[f.Name]; ok {
+			out = v
+		}
+
+		if out != key {
+			remap[key] = out
+		}
+
+	}
+
+}
+
+// Split a Go identifier into lower-case words, keeping acronyms together,
+// e.g. "ASNum" -> "as", "num".
+func splitWords(name string) []string {
+
+	var words []string
+	r := []rune(name)
+	start := 0
+
+	for i := 1; i < len(r); i++ {
+		prev, cur := r[i-1], r[i]
+		nextLower := i+1 < len(r) && unicode.IsLower(r[i+1])
+		if unicode.IsUpper(cur) &&
+			(unicode.IsLower(prev) || unicode.IsDigit(prev) ||
+				(unicode.IsUpper(prev) && nextLower)) {
+			words = append(words, strings.ToLower(string(r[start:i])))
+			start = i
+		}
+	}
+
+	return append(words, strings.ToLower(string(r[start:])))
+
+}
+
+// Rename keys throughout a decoded JSON value.
+func remapKeys(v interface{}) interface{} {
+
+	switch v := v.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			if n, ok := keyRemap[k]; ok {
+				k = n
+			}
+			out[k] = remapKeys(e)
+		}
+		return out
+	case []interface{}:
+		for i, e := range v {
+			v[i] = remapKeys(e)
+		}
+		return v
+	default:
+		return v
+	}
+
+}
+
+// Serialise a place, applying any configured key remapping.
+func (p *place) MarshalJSON() ([]byte, error) {
+
+	// Hash mode: the hash stands in for the details.
+	if hashLocations && p.LocationHash != "" {
+		return json.Marshal(&struct {
+			LocationHash string `json:"location_hash"`
+		}{p.LocationHash})
+	}
+
+	// Converting to a type without the method avoids recursion.
+	type plain place
+	if keyRemap == nil {
+		return json.Marshal((*plain)(p))
+	}
+
+	// Remapped once, over the place and those nested in it.
+	v, err := p.fields()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(remapKeys(v))
+
+}
+
+// A place as decoded JSON, with its own keys, and the places nested in it
+// the same way.
+func (p *place) fields() (interface{}, error) {
+
+	if hashLocations && p.LocationHash != "" {
+		return map[string]interface{}{"location_hash": p.LocationHash},
+			nil
+	}
+
+	// Without the nested places, which would remap their own keys.
+	c := *p
+	c.V4, c.V6 = nil, nil
+	type plain place
+	j, err := json.Marshal((*plain)(&c))
+	if err != nil {
+		return nil, err
+	}
+
+	// Decode keeping numbers intact.
+	var v map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(j))
+	dec.UseNumber()
+	err = dec.Decode(&v)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, n := range []struct {
+		key string
+		p   *place
+	}{{"v4", p.V4}, {"v6", p.V6}} {
+		if n.p == nil {
+			continue
+		}
+		v[n.key], err = n.p.fields()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return v, nil
+
+}
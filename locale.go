@@ -0,0 +1,37 @@
+//
+// Name localisation.  Names come from the first locale in GEOIP_LOCALES
+// (default "en") which the database has a name in.  Native names use the
+// main language of the country, where the databases carry it.
+//
+
+package main
+
+// MaxMind name locale for the main language of each country, for the
+// locales the databases carry.
+var nativeLocales = map[string]string{
+	"AR": "es", "AT": "de", "BO": "es", "BR": "pt-BR", "BY": "ru",
+	"CH": "de", "CL": "es", "CN": "zh-CN", "CO": "es", "CR": "es",
+	"CU": "es", "DE": "de", "DO": "es", "EC": "es", "ES": "es",
+	"FR": "fr", "GT": "es", "HN": "es", "JP": "ja", "KZ": "ru",
+	"KG": "ru", "LI": "de", "MX": "es", "NI": "es", "PA": "es",
+	"PE": "es", "PT": "pt-BR", "PY": "es", "RU": "ru", "SV": "es",
+	"UY": "es", "VE": "es",
+}
+
+// The name in the first configured locale there is one for.
+func (s *work) localName(names map[string]string) string {
+	for _, l := range s.locales {
+		if n, ok := names[l]; ok {
+			return n
+		}
+	}
+	return ""
+}
+
+// The name in the country's main language, if there is one.
+func nativeName(names map[string]string, iso string) string {
+	if l, ok := nativeLocales[iso]; ok {
+		return names[l]
+	}
+	return ""
+}
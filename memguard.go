@@ -0,0 +1,85 @@
+//
+// Memory guard.  With GEOIP_MEMORY_LIMIT_MB set, the Go heap is checked every
+// GEOIP_MEMORY_CHECK_INTERVAL.  Over the limit, the in-process caches are
+// halved each check, down to nothing, so the cache stays an optimisation
+// rather than an OOM risk.  Once the heap is under half the limit, they go
+// back to their configured sizes.  A config reload meanwhile sets the sizes
+// they go back to, and cuts them as far as the guard has.
+//
+
+package main
+
+import (
+	"runtime"
+	"time"
+
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+// Goroutine: keep the heap under the limit, in bytes.
+func (s *work) memoryGuard(limit uint64, interval time.Duration) {
+
+	if s.cache == nil && s.flowCache == nil {
+		return
+	}
+
+	var ms runtime.MemStats
+	for range time.Tick(interval) {
+		runtime.ReadMemStats(&ms)
+		s.checkMemory(ms.HeapAlloc, limit)
+	}
+
+}
+
+// Cut or restore the caches for the heap size.  The guard is the only
+// writer of the cut, so can read it without the lock.
+func (s *work) checkMemory(heap, limit uint64) {
+
+	switch {
+
+	case heap > limit && !s.cachesEmpty():
+		s.lock.Lock()
+		s.cacheShift++
+		sizes := s.resizeCaches()
+		s.lock.Unlock()
+		utils.Log("Heap %d MB is over the %d MB limit, caches cut "+
+			"to %v entries", heap>>20, limit>>20, sizes)
+
+		// Free the evicted entries before the next check.
+		runtime.GC()
+
+	case heap < limit/2 && s.cacheShift > 0:
+		s.lock.Lock()
+		s.cacheShift = 0
+		sizes := s.resizeCaches()
+		s.lock.Unlock()
+		utils.Log("Heap %d MB is under half the %d MB limit, caches "+
+			"restored to %v entries", heap>>20, limit>>20, sizes)
+
+	}
+
+}
+
+// Whether the guard has cut the caches to nothing.
+func (s *work) cachesEmpty() bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.cacheSize>>s.cacheShift == 0 &&
+		s.flowCacheSize>>s.cacheShift == 0
+}
+
+// Resize the caches to their configured sizes, as cut by the guard,
+// returning the sizes of those there are.  Call with the lock held.
+func (s *work) resizeCaches() []int {
+	var sizes []int
+	for _, c := range []struct {
+		c    *lru
+		size int
+	}{{s.cache, s.cacheSize}, {s.flowCache, s.flowCacheSize}} {
+		if c.c != nil {
+			c.c.resize(c.size >> s.cacheShift)
+			sizes = append(sizes, c.size>>s.cacheShift)
+		}
+	}
+	return sizes
+}
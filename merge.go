@@ -0,0 +1,76 @@
+//
+// Merging resolved locations into a location an upstream stage has already
+// partly filled in.  Existing fields are kept, and only empty ones are set.
+//
+
+package main
+
+import (
+	"reflect"
+)
+
+// Merge a resolved location into an existing one, returning the result.
+// Neither argument is modified, as the resolved location may be shared with
+// the flow cache.
+func mergeLocation(existing, resolved *locationInfo) *locationInfo {
+
+	if existing == nil {
+		return resolved
+	}
+	if resolved == nil {
+		return existing
+	}
+
+	merged := *existing
+	merged.Src = mergePlace(existing.Src, resolved.Src)
+	merged.Dest = mergePlace(existing.Dest, resolved.Dest)
+	if merged.EnrichedAt == "" {
+		merged.EnrichedAt = resolved.EnrichedAt
+	}
+	if merged.RiskScore == nil {
+		merged.RiskScore = resolved.RiskScore
+	}
+
+	return &merged
+
+}
+
+// Merge a resolved place into an existing one.
+func mergePlace(existing, resolved *place) *place {
+
+	if existing == nil {
+		return resolved
+	}
+	if resolved == nil {
+		return existing
+	}
+
+	merged := *existing
+	fillEmpty(reflect.ValueOf(&merged).Elem(), reflect.ValueOf(resolved).Elem())
+	return &merged
+
+}
+
+// Set empty fields of dst from src, descending into nested structs.
+func fillEmpty(dst, src reflect.Value) {
+
+	for i := 0; i < dst.NumField(); i++ {
+
+		d := dst.Field(i)
+		if !d.CanSet() {
+			continue
+		}
+
+		if d.Kind() == reflect.Struct {
+			fillEmpty(d, src.Field(i))
+			continue
+		}
+
+		zero := reflect.Zero(d.Type()).Interface()
+		if reflect.DeepEqual(d.Interface(), zero) {
+			d.Set(src.Field(i))
+		}
+
+	}
+
+}
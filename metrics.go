@@ -0,0 +1,102 @@
+//
+// Counters, published with expvar.  They're served at /debug/vars on the
+// HTTP control endpoint when it's enabled.
+//
+
+package main
+
+import (
+	"expvar"
+	"time"
+
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+var (
+	// Messages which couldn't be decoded.
+	malformedMessages = expvar.NewInt("geoip_malformed_messages")
+
+	// Messages over the size limit.
+	oversizeMessages = expvar.NewInt("geoip_oversize_messages")
+
+	// Events with no IP address in either direction.
+	noAddressMessages = expvar.NewInt("geoip_no_address_messages")
+
+	// Events whose handling panicked.
+	panics = expvar.NewInt("geoip_panics")
+
+	// Event address lookups, cached or not.
+	lookups = expvar.NewInt("geoip_lookups")
+
+	// Event address lookups by where the result came from: "database",
+	// "cache" or "flow cache".
+	lookupSourceCounts = expvar.NewMap("geoip_lookup_sources")
+)
+
+// Count lookups by where their results came from.
+func countSources(sources lookupSources) {
+	for _, src := range []string{sources.Src, sources.Dest} {
+		if src != "" {
+			lookupSourceCounts.Add(src, 1)
+		}
+	}
+}
+
+// Publish cache figures, for the caches which are enabled.
+func (s *work) publishCacheStats() {
+	if s.cache != nil {
+		expvar.Publish("geoip_cache", expvar.Func(func() interface{} {
+			return s.cache.stats()
+		}))
+	}
+	if s.flowCache != nil {
+		expvar.Publish("geoip_flow_cache", expvar.Func(func() interface{} {
+			return s.flowCache.stats()
+		}))
+	}
+}
+
+// Goroutine: periodically log that the worker is alive, with the databases
+// it's serving, lookups so far and the cache size.
+func (s *work) heartbeat(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+
+		s.lock.RLock()
+		var cityEpoch, asnEpoch uint
+		if s.cityDB.loaded() {
+			cityEpoch = s.cityDB.reader.Metadata().BuildEpoch
+		}
+		if s.asnDB.loaded() {
+			asnEpoch = s.asnDB.reader.Metadata().BuildEpoch
+		}
+		s.lock.RUnlock()
+
+		size := 0
+		if s.cache != nil {
+			size = s.cache.len()
+		}
+
+		utils.Log("Heartbeat: city epoch %d, ASN epoch %d, %d lookups, "+
+			"%d cache entries", cityEpoch, asnEpoch, lookups.Value(), size)
+	}
+}
+
+// Goroutine: periodically log cache figures.
+func (s *work) cacheStatsLogger(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		for _, c := range []struct {
+			name  string
+			cache *lru
+		}{{"Address", s.cache}, {"Flow", s.flowCache}} {
+			if c.cache == nil {
+				continue
+			}
+			st := c.cache.stats()
+			utils.Log("%s cache: %d entries, %d hits, %d misses "+
+				"(hit rate %.1f%%), %d evictions", c.name, st.Size,
+				st.Hits, st.Misses, st.HitRate*100, st.Evictions)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+//
+// NAT64 addresses (RFC6052), which embed an IPv4 address after a NAT64
+// prefix.  The well-known prefix is 64:ff9b::/96, but networks can use their
+// own, of length 32, 40, 48, 56, 64 or 96.  An address under one of them
+// which misses is looked up again by its embedded IPv4 address.
+//
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// NAT64 prefixes.
+type nat64Prefixes []*net.IPNet
+
+// Parse a comma-separated prefix list.
+func parseNAT64Prefixes(v string) (nat64Prefixes, error) {
+
+	var p nat64Prefixes
+	for _, c := range strings.Split(v, ",") {
+
+		c = strings.TrimSpace(c)
+		if c == "" {
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, err
+		}
+
+		ones, bits := n.Mask.Size()
+		if bits != 8*net.IPv6len {
+			return nil, fmt.Errorf("%s isn't an IPv6 prefix", c)
+		}
+		switch ones {
+		case 32, 40, 48, 56, 64, 96:
+		default:
+			return nil, fmt.Errorf("%s: prefix length must be 32, 40, "+
+				"48, 56, 64 or 96", c)
+		}
+
+		p = append(p, n)
+
+	}
+
+	return p, nil
+
+}
+
+// IPv4 address embedded in an address under one of the prefixes, or nil.
+func (p nat64Prefixes) embedded(ip net.IP) net.IP {
+
+	if ip.To4() != nil {
+		return nil
+	}
+
+	for _, n := range p {
+
+		if !n.Contains(ip) {
+			continue
+		}
+
+		// The IPv4 address follows the prefix, skipping bits 64 to 71,
+		// which are reserved.
+		ones, _ := n.Mask.Size()
+		v4 := make(net.IP, 0, net.IPv4len)
+		for i := ones / 8; len(v4) < net.IPv4len; i++ {
+			if i != 8 {
+				v4 = append(v4, ip[i])
+			}
+		}
+		return v4
+
+	}
+
+	return nil
+
+}
@@ -0,0 +1,246 @@
+//
+// Opening database files.  Every database, required or optional, is opened
+// through openDatabase, with options for how the file is loaded and what is
+// checked before it is used.
+//
+// GEOIP_DEFAULT_LOAD_MODE ("mmap", the default, or "memory") and
+// GEOIP_DEFAULT_VERIFY (full structural check) apply to all databases;
+// GEOIP_DB_LOAD_MODE for the City one, GEOIP_ASN_DB_VERIFY and so on, after
+// each database's filename variable, override them for one.  Memory loading
+// copies the file into the heap, so a later change to the file can't affect
+// the open reader.  Either way the file is read, or mapped, once, and the
+// typed and raw readers share it.
+//
+// For sidecar deployments, a database filename can also be
+// "unix:/path/to/socket", read to EOF from a Unix socket, or "fd:N", read
+// from an inherited file descriptor.  These are read into memory once, and
+// never reloaded, but one which couldn't be read at startup is tried again
+// on each reload until it is.
+//
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/oschwald/geoip2-golang"
+	"github.com/oschwald/maxminddb-golang"
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+type openOptions struct {
+
+	// Read the file into memory rather than mapping it.
+	memory bool
+
+	// Run the full structural check.
+	verify bool
+
+	// If set, the database type must contain this.
+	edition string
+}
+
+// An option for openDatabase.
+type openOption func(*openOptions)
+
+func withMemory(on bool) openOption {
+	return func(o *openOptions) { o.memory = on }
+}
+
+func withVerify(on bool) openOption {
+	return func(o *openOptions) { o.verify = on }
+}
+
+func withEdition(edition string) openOption {
+	return func(o *openOptions) { o.edition = edition }
+}
+
+// An open database file: its readers, metadata and file details.
+type openedDB struct {
+	reader   *geoip2.Reader
+	raw      *maxminddb.Reader
+	metadata maxminddb.Metadata
+	mtime    time.Time
+	size     int64
+
+	// The file mapping the readers share, nil if it's in the heap.
+	mapped []byte
+}
+
+func (o *openedDB) close() {
+	closeReaders(o.reader, o.raw, o.mapped)
+}
+
+// Close a database's readers, then unmap the file they share, if mapped.
+func closeReaders(reader *geoip2.Reader, raw *maxminddb.Reader,
+	mapped []byte) {
+	if reader != nil {
+		reader.Close()
+	}
+	if raw != nil {
+		raw.Close()
+	}
+	if mapped != nil {
+		syscall.Munmap(mapped)
+	}
+}
+
+// Open a database file, checking it according to the options.
+func openDatabase(path string, opts ...openOption) (*openedDB, error) {
+
+	var o openOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	db := &openedDB{}
+	var buf []byte
+	if streamSource(path) {
+		var err error
+		buf, err = readStream(path)
+		if err != nil {
+			return nil, err
+		}
+		db.mtime = time.Now()
+		db.size = int64(len(buf))
+	} else {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		db.mtime = info.ModTime()
+		db.size = info.Size()
+		if o.memory {
+			buf, err = ioutil.ReadFile(path)
+		} else {
+			buf, err = mapFile(path, db.size)
+			db.mapped = buf
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Both readers over the one copy.
+	var err error
+	db.raw, err = maxminddb.FromBytes(buf)
+	if err != nil {
+		db.close()
+		return nil, err
+	}
+	db.reader, err = geoip2.FromBytes(buf)
+	if err != nil {
+		db.close()
+		return nil, err
+	}
+	db.metadata = db.raw.Metadata
+
+	dbType := db.metadata.DatabaseType
+	if o.edition != "" && !strings.Contains(dbType, o.edition) {
+		db.close()
+		return nil, fmt.Errorf("%s is a %s database, expected %s", path,
+			dbType, o.edition)
+	}
+
+	if o.verify {
+		err = db.raw.Verify()
+		if err != nil {
+			db.close()
+			return nil, fmt.Errorf("%s failed verification: %s", path,
+				err.Error())
+		}
+	}
+
+	return db, nil
+
+}
+
+// Map a database file into memory, read-only.
+func mapFile(path string, size int64) ([]byte, error) {
+
+	if size == 0 {
+		return nil, fmt.Errorf("%s: empty file", path)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	buf, err := syscall.Mmap(int(f.Fd()), 0, int(size), syscall.PROT_READ,
+		syscall.MAP_SHARED)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err.Error())
+	}
+	return buf, nil
+
+}
+
+// Whether a database filename is a socket or descriptor rather than a file.
+func streamSource(path string) bool {
+	return strings.HasPrefix(path, "unix:") || strings.HasPrefix(path, "fd:")
+}
+
+// Read a whole database from a Unix socket or file descriptor.
+func readStream(path string) ([]byte, error) {
+
+	var r io.ReadCloser
+	if strings.HasPrefix(path, "unix:") {
+		conn, err := net.Dial("unix", strings.TrimPrefix(path, "unix:"))
+		if err != nil {
+			return nil, err
+		}
+		r = conn
+	} else {
+		fd, err := strconv.Atoi(strings.TrimPrefix(path, "fd:"))
+		if err != nil || fd < 0 {
+			return nil, fmt.Errorf("%s: bad file descriptor", path)
+		}
+		r = os.NewFile(uintptr(fd), path)
+	}
+	defer r.Close()
+
+	buf, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err.Error())
+	}
+	if len(buf) == 0 {
+		return nil, fmt.Errorf("%s: no data", path)
+	}
+	return buf, nil
+
+}
+
+// Open options for a database from the environment, given the prefix of
+// its filename variable, e.g. "GEOIP_ASN_DB".
+func dbOptions(prefix string) ([]openOption, error) {
+
+	mode := utils.Getenv(prefix+"_LOAD_MODE",
+		utils.Getenv("GEOIP_DEFAULT_LOAD_MODE", "mmap"))
+	if mode != "mmap" && mode != "memory" {
+		return nil, fmt.Errorf("%s_LOAD_MODE: unknown mode: %s", prefix,
+			mode)
+	}
+
+	verify, err := getenvBool("GEOIP_DEFAULT_VERIFY", false)
+	if err != nil {
+		return nil, err
+	}
+	verify, err = getenvBool(prefix+"_VERIFY", verify)
+	if err != nil {
+		return nil, err
+	}
+
+	return []openOption{withMemory(mode == "memory"), withVerify(verify)},
+		nil
+
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+// A database file is mapped, or read, once, with both readers over it.
+func TestOpenDatabaseShared(t *testing.T) {
+
+	dir, cleanup := testDir(t)
+	defer cleanup()
+
+	path := testDB(t, dir, "city.mmdb", "GeoLite2-City", 1,
+		[]testNetwork{{"1.2.3.0/24",
+			testCityRecord("GB", "United Kingdom", "London")}})
+
+	for _, memory := range []bool{false, true} {
+
+		db, err := openDatabase(path, withMemory(memory),
+			withEdition("City"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (db.mapped != nil) == memory {
+			t.Errorf("memory %v: mapped %v", memory, db.mapped != nil)
+		}
+
+		ip := net.ParseIP("1.2.3.4")
+		city, err := db.reader.City(ip)
+		if err != nil || city.City.Names["en"] != "London" {
+			t.Errorf("memory %v: typed lookup %+v, %v", memory, city, err)
+		}
+		var rec struct {
+			Country struct {
+				IsoCode string `maxminddb:"iso_code"`
+			} `maxminddb:"country"`
+		}
+		err = db.raw.Lookup(ip, &rec)
+		if err != nil || rec.Country.IsoCode != "GB" {
+			t.Errorf("memory %v: raw lookup %+v, %v", memory, rec, err)
+		}
+
+		db.close()
+
+	}
+
+}
+
+// The defaults apply to every database, and the City database's own
+// settings, named after GEOIP_DB, apply to it alone.
+func TestDBOptionsDefaults(t *testing.T) {
+
+	defer setTestEnv(map[string]string{
+		"GEOIP_DEFAULT_LOAD_MODE": "memory",
+		"GEOIP_DEFAULT_VERIFY":    "true",
+		"GEOIP_DB_LOAD_MODE":      "mmap",
+		"GEOIP_DB_VERIFY":         "false",
+	})()
+
+	get := func(prefix string) openOptions {
+		opts, err := dbOptions(prefix)
+		if err != nil {
+			t.Fatalf("%s: %s", prefix, err.Error())
+		}
+		var o openOptions
+		for _, opt := range opts {
+			opt(&o)
+		}
+		return o
+	}
+
+	if o := get("GEOIP_DB"); o.memory || o.verify {
+		t.Errorf("City database options %+v, wanted its own", o)
+	}
+	if o := get("GEOIP_ASN_DB"); !o.memory || !o.verify {
+		t.Errorf("ASN database options %+v, wanted the defaults", o)
+	}
+
+}
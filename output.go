@@ -0,0 +1,251 @@
+//
+// Output formatters.  The enriched event JSON can be sent as-is ("raw",
+// the default) or wrapped in an envelope for consumers which expect one.
+// Selected with GEOIP_OUTPUT_FORMAT.
+//
+//   raw          The event JSON, unchanged.
+//   cloudevents  A CloudEvents 1.0 structured-mode JSON envelope with the
+//                event as data.  The geo enrichment is also carried in the
+//                "geolocation" extension attribute, as a JSON string, so
+//                routers can use it without parsing the data.  Source and
+//                type come from GEOIP_CE_SOURCE and GEOIP_CE_TYPE.
+//   enrichment   A versioned, self-describing envelope, with the location
+//                and what produced it alongside the event:
+//
+//     {
+//       "schema": "geoip-enrichment",
+//       "schema_version": 1,
+//       "enrichment": {
+//         "source": "geoip",
+//         "worker": "<GEOIP_WORKER_ID, or the hostname>",
+//         "worker_version": "<build version>",
+//         "time": "<RFC3339 time of enrichment>",
+//         "databases": [
+//           { "name": "City", "type": "GeoLite2-City",
+//             "build_time": "<RFC3339>" }
+//         ]
+//       },
+//       "traceparent": "<W3C trace context, if the event has one>",
+//       "location": { ... },
+//       "event": { ... }
+//     }
+//
+//                Fields are only added within a schema version.  Renames,
+//                removals and changes of meaning bump it.
+//
+// Events passed through un-enriched, by sampling or backpressure shedding,
+// are wrapped too.  Oversize messages forwarded by GEOIP_OVERSIZE_ACTION are
+// always sent bare, as wrapping means decoding them, which the size limit is
+// there to avoid.
+//
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/trustnetworks/analytics-common/utils"
+	"github.com/trustnetworks/analytics-common/worker"
+)
+
+// Wraps a serialised event for output.
+type formatter interface {
+	format(ev *event, body []byte) ([]byte, error)
+}
+
+// Create the formatter named by the configuration.  s supplies database
+// details for the enrichment envelope.
+func newFormatter(name string, s *work) (formatter, error) {
+	switch name {
+	case "raw":
+		return rawFormatter{}, nil
+	case "cloudevents":
+		return &cloudEventsFormatter{
+			source: utils.Getenv("GEOIP_CE_SOURCE", "/analytics/geoip"),
+			eventType: utils.Getenv("GEOIP_CE_TYPE",
+				"com.trustnetworks.analytics.event"),
+		}, nil
+	case "enrichment":
+		worker := utils.Getenv("GEOIP_WORKER_ID", "")
+		if worker == "" {
+			worker, _ = os.Hostname()
+		}
+		return &enrichmentFormatter{s: s, worker: worker}, nil
+	default:
+		return nil, fmt.Errorf("GEOIP_OUTPUT_FORMAT: unknown format: %s",
+			name)
+	}
+}
+
+// Send an event on un-enriched, wrapped as enriched events are, so that
+// consumers see one output shape.  The event is only decoded if the
+// formatter needs its fields.
+func (s *work) passThrough(w *worker.Worker, out string, msg []byte) error {
+
+	if _, ok := s.formatter.(rawFormatter); ok {
+		s.send(w, out, msg)
+		return nil
+	}
+
+	var ev event
+	err := json.Unmarshal(msg, &ev)
+	if err != nil {
+		malformedMessages.Add(1)
+		s.errLog.log("Couldn't unmarshal json: %s", err.Error())
+		return nil
+	}
+
+	j, err := s.formatter.format(&ev, msg)
+	if err != nil {
+		return s.failed(w, msg, fmt.Errorf("output format error: %s",
+			err.Error()))
+	}
+	s.send(w, out, j)
+	return nil
+
+}
+
+// Current behaviour: the event JSON as it is.
+type rawFormatter struct{}
+
+func (rawFormatter) format(ev *event, body []byte) ([]byte, error) {
+	return body, nil
+}
+
+// CloudEvents structured-mode envelope.
+type cloudEventsFormatter struct {
+	source    string
+	eventType string
+}
+
+type cloudEvent struct {
+	SpecVersion     string          `json:"specversion"`
+	ID              string          `json:"id"`
+	Source          string          `json:"source"`
+	Type            string          `json:"type"`
+	Time            string          `json:"time,omitempty"`
+	DataContentType string          `json:"datacontenttype"`
+	Geolocation     string          `json:"geolocation,omitempty"`
+	Data            json.RawMessage `json:"data"`
+}
+
+func (f *cloudEventsFormatter) format(ev *event, body []byte) ([]byte,
+	error) {
+
+	ce := cloudEvent{
+		SpecVersion:     "1.0",
+		ID:              ev.Id,
+		Source:          f.source,
+		Type:            f.eventType,
+		DataContentType: "application/json",
+		Data:            body,
+	}
+
+	// Events without an ID get a random one.
+	if ce.ID == "" {
+		b := make([]byte, 16)
+		_, err := rand.Read(b)
+		if err != nil {
+			return nil, err
+		}
+		ce.ID = hex.EncodeToString(b)
+	}
+
+	// Only pass through a time CloudEvents will accept.
+	if _, err := time.Parse(time.RFC3339Nano, ev.Time); err == nil {
+		ce.Time = ev.Time
+	}
+
+	if ev.Location != nil {
+		loc, err := json.Marshal(ev.Location)
+		if err != nil {
+			return nil, err
+		}
+		ce.Geolocation = string(loc)
+	}
+
+	return json.Marshal(&ce)
+
+}
+
+// Versioned enrichment envelope.
+type enrichmentFormatter struct {
+	s      *work
+	worker string
+}
+
+// Enrichment envelope schema version.
+const enrichmentSchemaVersion = 1
+
+type enrichmentDB struct {
+	Name      string `json:"name"`
+	Type      string `json:"type"`
+	BuildTime string `json:"build_time"`
+}
+
+type enrichmentInfo struct {
+	Source        string         `json:"source"`
+	Worker        string         `json:"worker,omitempty"`
+	WorkerVersion string         `json:"worker_version"`
+	Time          string         `json:"time"`
+	Databases     []enrichmentDB `json:"databases"`
+}
+
+type enrichmentRecord struct {
+	Schema        string          `json:"schema"`
+	SchemaVersion int             `json:"schema_version"`
+	Enrichment    enrichmentInfo  `json:"enrichment"`
+	TraceParent   string          `json:"traceparent,omitempty"`
+	Location      *locationInfo   `json:"location,omitempty"`
+	Event         json.RawMessage `json:"event"`
+}
+
+func (f *enrichmentFormatter) format(ev *event, body []byte) ([]byte,
+	error) {
+
+	rec := enrichmentRecord{
+		Schema:        "geoip-enrichment",
+		SchemaVersion: enrichmentSchemaVersion,
+		Enrichment: enrichmentInfo{
+			Source:        "geoip",
+			Worker:        f.worker,
+			WorkerVersion: version,
+			Time:          time.Now().UTC().Format(time.RFC3339),
+			Databases:     f.databases(),
+		},
+		TraceParent: ev.TraceParent,
+		Location:    ev.Location,
+		Event:       body,
+	}
+
+	return json.Marshal(&rec)
+
+}
+
+// The open databases.
+func (f *enrichmentFormatter) databases() []enrichmentDB {
+
+	f.s.lock.RLock()
+	defer f.s.lock.RUnlock()
+
+	dbs := []enrichmentDB{}
+	for _, d := range append(f.s.requiredDBs(), f.s.optionalDBs()...) {
+		if !d.loaded() {
+			continue
+		}
+		md := d.reader.Metadata()
+		dbs = append(dbs, enrichmentDB{
+			Name: d.name,
+			Type: md.DatabaseType,
+			BuildTime: time.Unix(int64(md.BuildEpoch), 0).UTC().
+				Format(time.RFC3339),
+		})
+	}
+	return dbs
+
+}
@@ -0,0 +1,110 @@
+//
+// Location overrides for address ranges the databases get wrong.  The file
+// is a JSON object mapping CIDRs to location records, e.g.
+//
+//   {
+//     "192.0.2.0/24": {
+//       "city": "London", "iso": "GB", "country": "United Kingdom",
+//       "position": { "lat": 51.5, "lon": -0.12 }
+//     }
+//   }
+//
+// Record keys are the native location keys, whatever GEOIP_KEY_STYLE says.
+// The most specific matching range wins.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+)
+
+// Override ranges, indexed for longest-prefix matching.
+type overrides struct {
+
+	// Prefix lengths in use, longest first, for each address length.
+	lengths map[int][]int
+
+	// Location by address length, prefix length and network address.
+	ranges map[int]map[int]map[string]*place
+}
+
+// Load overrides from a file.
+func loadOverrides(filename string) (*overrides, error) {
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var recs map[string]*place
+	err = json.NewDecoder(f).Decode(&recs)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err.Error())
+	}
+
+	o := &overrides{
+		lengths: map[int][]int{},
+		ranges:  map[int]map[int]map[string]*place{},
+	}
+
+	for cidr, p := range recs {
+
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", filename, err.Error())
+		}
+		if p == nil {
+			return nil, fmt.Errorf("%s: no location for %s", filename,
+				cidr)
+		}
+
+		ones, bits := n.Mask.Size()
+		if o.ranges[bits] == nil {
+			o.ranges[bits] = map[int]map[string]*place{}
+		}
+		if o.ranges[bits][ones] == nil {
+			o.ranges[bits][ones] = map[string]*place{}
+			o.lengths[bits] = append(o.lengths[bits], ones)
+		}
+		o.ranges[bits][ones][string(n.IP)] = p
+
+	}
+
+	for _, l := range o.lengths {
+		sort.Sort(sort.Reverse(sort.IntSlice(l)))
+	}
+
+	return o, nil
+
+}
+
+// Override location for an address, or nil.
+func (o *overrides) lookup(ip net.IP) *place {
+
+	if o == nil {
+		return nil
+	}
+
+	// Match IPv4 addresses in their 4-byte form, as ParseCIDR gives IPv4
+	// networks.
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+	bits := len(ip) * 8
+
+	for _, ones := range o.lengths[bits] {
+		n := ip.Mask(net.CIDRMask(ones, bits))
+		if p, ok := o.ranges[bits][ones][string(n)]; ok {
+			return p
+		}
+	}
+
+	return nil
+
+}
@@ -0,0 +1,300 @@
+//
+// Location types attached to events.  dt.Place and dt.LocationInfo are the
+// schema shared with the rest of the analytics; the types here embed them
+// and carry the fields this worker adds on top.
+//
+// Every added field is optional, and must be tagged omitempty, or be a
+// pointer where zero is a meaningful value, so that an address which only
+// resolves a few fields serialises as a compact object.
+//
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+
+	dt "github.com/trustnetworks/analytics-common/datatypes"
+)
+
+// When set, a direction without a location is left out of the location
+// object rather than serialised as null.
+var omitEmptyDirection bool
+
+// When set, locations are serialised as just their location hash.
+var hashLocations bool
+
+// GeoIP information for one address.
+type place struct {
+	dt.Place
+
+	// ISO 3166-1 alpha-3 country code, if enabled.
+	IsoCode3 string `json:"iso3,omitempty"`
+
+	// Continent two-letter code and name.
+	ContinentCode string `json:"continent_code,omitempty"`
+	Continent     string `json:"continent,omitempty"`
+
+	// Name of the largest subdivision (state, region, oblast...), and its
+	// name in the country's own language where that differs.
+	Subdivision       string `json:"subdivision,omitempty"`
+	SubdivisionNative string `json:"subdivision_native,omitempty"`
+
+	// The country the address block is registered to, and, when that is
+	// the primary country, the country the address is physically in.
+	RegisteredIsoCode string `json:"registered_iso,omitempty"`
+	RegisteredCountry string `json:"registered_country,omitempty"`
+	PhysicalIsoCode   string `json:"physical_iso,omitempty"`
+	PhysicalCountry   string `json:"physical_country,omitempty"`
+
+	// IANA time zone name, and its UTC offset at the event's time, e.g.
+	// "+01:00", if enabled.
+	TimeZone  string `json:"timezone,omitempty"`
+	UTCOffset string `json:"utc_offset,omitempty"`
+
+	// GeoNames IDs, if enabled, for joining against reference data.  The
+	// subdivision is the largest one the address is in.
+	CityGeoNameID        uint `json:"city_geoname_id,omitempty"`
+	CountryGeoNameID     uint `json:"country_geoname_id,omitempty"`
+	SubdivisionGeoNameID uint `json:"subdivision_geoname_id,omitempty"`
+
+	// Country the autonomous system is registered in, which can differ
+	// from where the address geolocates.  Only set when an ASN country
+	// table is configured.
+	ASCountry string `json:"as_country,omitempty"`
+
+	// Set, if enabled, when the address geolocates outside the ASN's
+	// country.
+	CountryASNMismatch bool `json:"country_asn_mismatch,omitempty"`
+
+	// The country's flag, as a pair of regional indicator symbols, if
+	// enabled.
+	FlagEmoji string `json:"flag_emoji,omitempty"`
+
+	// Number of networks the ASN has in the ASN database, if enabled.
+	ASNPrefixCount int `json:"asn_prefix_count,omitempty"`
+
+	// Regional Internet Registry for the ASN, or failing that the address,
+	// if enabled.
+	Rir string `json:"rir,omitempty"`
+
+	// ISP database fields, only set when that database is loaded.  ASOrg
+	// above is the organisation holding the ASN; ISP is the provider
+	// serving the address and Organization the customer it is assigned
+	// to, either of which may be a reseller or customer of the ASN holder.
+	ISP          string `json:"isp,omitempty"`
+	Organization string `json:"organization,omitempty"`
+
+	// Connection type, e.g. "Cable/DSL", from an Enterprise database.
+	ConnectionType string `json:"connection_type,omitempty"`
+
+	// Who uses the address, e.g. "residential", "business", "hosting" or
+	// "cellular", from an Enterprise database.
+	UserType string `json:"user_type,omitempty"`
+
+	// How static the address assignment is, 0 to 99.99, from an Enterprise
+	// database, if enabled.  Zero is a real score.
+	StaticIPScore *float64 `json:"static_ip_score,omitempty"`
+
+	// Enterprise confidence, 0 to 100, in each of the location fields.
+	CountryConfidence     uint8 `json:"country_confidence,omitempty"`
+	SubdivisionConfidence uint8 `json:"subdivision_confidence,omitempty"`
+	CityConfidence        uint8 `json:"city_confidence,omitempty"`
+	PostCodeConfidence    uint8 `json:"postcode_confidence,omitempty"`
+
+	// Country metadata from the bundled table, if enabled: ITU calling
+	// code (no "+") and ISO 4217 currency.
+	CallingCode string `json:"calling_code,omitempty"`
+	Currency    string `json:"currency,omitempty"`
+
+	// Anonymous-IP database flags, only set when that database is loaded.
+	// IsAnonymous is set for any of the anonymising categories below;
+	// IsHostingProvider marks hosting/cloud ranges, which needn't be
+	// anonymous but often front other traffic.
+	IsAnonymous       bool `json:"is_anonymous,omitempty"`
+	IsAnonymousVPN    bool `json:"is_anonymous_vpn,omitempty"`
+	IsHostingProvider bool `json:"is_hosting_provider,omitempty"`
+	IsPublicProxy     bool `json:"is_public_proxy,omitempty"`
+	IsTorExitNode     bool `json:"is_tor_exit_node,omitempty"`
+
+	// Set for addresses in the configured anycast ranges, whose database
+	// location is only one of many places they're served from.
+	IsAnycast bool `json:"is_anycast,omitempty"`
+
+	// Great-circle distance from the configured reference point.
+	DistanceFromRefKm *float64 `json:"distance_from_ref_km,omitempty"`
+
+	// Set to "country" when the position is a country centroid standing in
+	// for missing city coordinates.
+	PositionSource string `json:"position_source,omitempty"`
+
+	// Accuracy radius in the configured unit, if other than kilometres,
+	// alongside the integer kilometres in AccuracyRadius.
+	AccuracyRadiusValue *float64 `json:"accuracy_radius_value,omitempty"`
+	AccuracyRadiusUnit  string   `json:"accuracy_radius_unit,omitempty"`
+
+	// Overall precision of the location, if enabled: "exact", "city",
+	// "region", "country" or "unknown".
+	Precision string `json:"precision,omitempty"`
+
+	// Geohash of the position, if enabled.
+	Geohash string `json:"geohash,omitempty"`
+
+	// Position as a GeoJSON point, if enabled.
+	GeoJSON *geoJSONPoint `json:"geojson,omitempty"`
+
+	// Hash of country, subdivision and city, in hash mode.
+	LocationHash string `json:"location_hash,omitempty"`
+
+	// Locations of each family of a dual-stack endpoint, if enabled and
+	// the event has both.
+	V4 *place `json:"v4,omitempty"`
+	V6 *place `json:"v6,omitempty"`
+}
+
+// Stable hash identifying a location by country, subdivision and city.
+func locationHash(p *place) string {
+	sum := sha256.Sum256([]byte(p.IsoCode + "|" + p.Subdivision + "|" +
+		p.City))
+	return hex.EncodeToString(sum[:8])
+}
+
+// GeoJSON point geometry.  Note GeoJSON coordinate order is longitude,
+// latitude.
+type geoJSONPoint struct {
+	Type        string     `json:"type"`
+	Coordinates [2]float64 `json:"coordinates"`
+}
+
+// Source and destination locations.
+type locationInfo struct {
+	Src  *place `json:"src"`
+	Dest *place `json:"dest"`
+
+	// When the location was attached, RFC3339, if enabled.
+	EnrichedAt string `json:"enriched_at,omitempty"`
+
+	// Composite risk score, 0 to 100, if enabled.
+	RiskScore *int `json:"risk_score,omitempty"`
+}
+
+// Serialise, leaving out a missing direction if configured to.
+func (l *locationInfo) MarshalJSON() ([]byte, error) {
+
+	if !omitEmptyDirection {
+		type plain locationInfo
+		return json.Marshal((*plain)(l))
+	}
+
+	return json.Marshal(&struct {
+		Src        *place `json:"src,omitempty"`
+		Dest       *place `json:"dest,omitempty"`
+		EnrichedAt string `json:"enriched_at,omitempty"`
+		RiskScore  *int   `json:"risk_score,omitempty"`
+	}{l.Src, l.Dest, l.EnrichedAt, l.RiskScore})
+
+}
+
+// Event record.  The Location field shadows dt.Event's, so that the
+// extended location information is decoded and serialised, and the address
+// lists shadow dt.Event's so that either address encoding is.
+type event struct {
+	dt.Event
+	Src      addrList      `json:"src,omitempty"`
+	Dest     addrList      `json:"dest,omitempty"`
+	Location *locationInfo `json:"location,omitempty"`
+
+	// Key for geography-aware partitioning downstream, if enabled.
+	PartitionKey string `json:"partition_key,omitempty"`
+
+	// Set on events chosen for enrichment when sampling is on.
+	Sampled bool `json:"geoip_sampled,omitempty"`
+
+	// Set, if enabled, when either address is in a documentation or other
+	// reserved range.
+	IsReserved bool `json:"is_reserved,omitempty"`
+
+	// Well-known service name of the destination port, if enabled.
+	DestService string `json:"dest_service,omitempty"`
+
+	// W3C trace context, kept as it was.
+	TraceParent string `json:"traceparent,omitempty"`
+
+	// Flat top-level copy of the main location fields, for consumers of
+	// the older flat schema, if enabled.  Added by MarshalJSON; not read
+	// from input events.
+	flat *flatLocation
+}
+
+// Serialise, with the flat location fields, if any, at the top level.
+func (e event) MarshalJSON() ([]byte, error) {
+
+	type plain event
+	j, err := json.Marshal(plain(e))
+	if err != nil || e.flat == nil {
+		return j, err
+	}
+
+	flat, err := json.Marshal(e.flat)
+	if err != nil {
+		return nil, err
+	}
+
+	// Join the two objects, either of which may be empty.
+	switch {
+	case len(flat) <= 2:
+		return j, nil
+	case len(j) <= 2:
+		return flat, nil
+	}
+	j = append(j[:len(j)-1:len(j)-1], ',')
+	return append(j, flat[1:]...), nil
+
+}
+
+// Flat location fields.
+type flatLocation struct {
+	SrcCity     string   `json:"src_city,omitempty"`
+	SrcIsoCode  string   `json:"src_iso,omitempty"`
+	SrcCountry  string   `json:"src_country,omitempty"`
+	SrcLat      *float64 `json:"src_lat,omitempty"`
+	SrcLon      *float64 `json:"src_lon,omitempty"`
+	SrcASNum    uint     `json:"src_asn,omitempty"`
+	SrcASOrg    string   `json:"src_asorg,omitempty"`
+	DestCity    string   `json:"dest_city,omitempty"`
+	DestIsoCode string   `json:"dest_iso,omitempty"`
+	DestCountry string   `json:"dest_country,omitempty"`
+	DestLat     *float64 `json:"dest_lat,omitempty"`
+	DestLon     *float64 `json:"dest_lon,omitempty"`
+	DestASNum   uint     `json:"dest_asn,omitempty"`
+	DestASOrg   string   `json:"dest_asorg,omitempty"`
+}
+
+// Flat fields for a location.
+func flatten(l *locationInfo) *flatLocation {
+
+	f := &flatLocation{}
+
+	if p := l.Src; p != nil {
+		f.SrcCity, f.SrcIsoCode, f.SrcCountry = p.City, p.IsoCode, p.Country
+		if p.Position != nil {
+			f.SrcLat = &p.Position.Latitude
+			f.SrcLon = &p.Position.Longitude
+		}
+		f.SrcASNum, f.SrcASOrg = p.ASNum, p.ASOrg
+	}
+
+	if p := l.Dest; p != nil {
+		f.DestCity, f.DestIsoCode, f.DestCountry =
+			p.City, p.IsoCode, p.Country
+		if p.Position != nil {
+			f.DestLat = &p.Position.Latitude
+			f.DestLon = &p.Position.Longitude
+		}
+		f.DestASNum, f.DestASOrg = p.ASNum, p.ASOrg
+	}
+
+	return f
+
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	dt "github.com/trustnetworks/analytics-common/datatypes"
+)
+
+// Events with flat location fields decode, and the flat fields are written
+// from the location, at the top level, only when set.
+func TestEventFlatLocationRoundTrip(t *testing.T) {
+
+	in := `{"id":"e1","src":["ipv4:1.2.3.4"],"src_country":"Stale",` +
+		`"src_lat":1.5,"dest_asn":1}`
+
+	var ev event
+	err := json.Unmarshal([]byte(in), &ev)
+	if err != nil {
+		t.Fatalf("decode: %s", err.Error())
+	}
+	if ev.Id != "e1" || len(ev.Src) != 1 || ev.flat != nil {
+		t.Fatalf("decoded %+v", ev)
+	}
+
+	// Without flat fields, none are written.
+	j, err := json.Marshal(ev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]interface{}
+	err = json.Unmarshal(j, &fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"src_country", "src_lat", "dest_asn"} {
+		if _, ok := fields[k]; ok {
+			t.Errorf("%s written without flat fields: %s", k, j)
+		}
+	}
+
+	// With them, they come from the location.
+	src := &place{}
+	src.City, src.IsoCode, src.Country = "London", "GB", "United Kingdom"
+	src.Position = &dt.Posn{Latitude: 51.5, Longitude: -0.1}
+	src.ASNum = 64500
+	ev.Location = &locationInfo{Src: src}
+	ev.flat = flatten(ev.Location)
+
+	j, err = json.Marshal(ev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields = nil
+	err = json.Unmarshal(j, &fields)
+	if err != nil {
+		t.Fatalf("bad JSON %s: %s", j, err.Error())
+	}
+	for k, want := range map[string]interface{}{
+		"id":          "e1",
+		"src_city":    "London",
+		"src_iso":     "GB",
+		"src_country": "United Kingdom",
+		"src_lat":     51.5,
+		"src_lon":     -0.1,
+		"src_asn":     64500.0,
+	} {
+		if fields[k] != want {
+			t.Errorf("%s: got %v, expected %v", k, fields[k], want)
+		}
+	}
+	if _, ok := fields["location"]; !ok {
+		t.Errorf("no location: %s", j)
+	}
+	if _, ok := fields["dest_asn"]; ok {
+		t.Errorf("dest_asn written for a missing direction: %s", j)
+	}
+
+	// And the output decodes again.
+	var again event
+	err = json.Unmarshal(j, &again)
+	if err != nil {
+		t.Fatalf("decode output: %s", err.Error())
+	}
+	if again.Location == nil || again.Location.Src.City != "London" {
+		t.Errorf("decoded output %+v", again)
+	}
+
+}
+
+// A place resolving only a country is written with only those keys, however
+// many optional fields there are.
+func TestMinimalPlaceCompact(t *testing.T) {
+
+	dir, cleanup := testDir(t)
+	defer cleanup()
+
+	s, closeDBs := testWork(t, map[string]string{
+		"GEOIP_DB": testDB(t, dir, "city.mmdb", "GeoLite2-City", 1,
+			[]testNetwork{{"1.2.3.0/24",
+				testCityRecord("GB", "United Kingdom", "")}}),
+		"GEOIP_ASN_DB": testDB(t, dir, "asn.mmdb", "GeoLite2-ASN", 1,
+			nil),
+	})
+	defer closeDBs()
+
+	out := testHandle(t, s, `{"id":"1","src":["ipv4:1.2.3.4"]}`)
+	var ev struct {
+		Location map[string]map[string]interface{} `json:"location"`
+	}
+	err := json.Unmarshal(out, &ev)
+	if err != nil {
+		t.Fatalf("bad output %q: %s", out, err.Error())
+	}
+
+	src := ev.Location["src"]
+	if len(src) != 2 || src["iso"] != "GB" ||
+		src["country"] != "United Kingdom" {
+		t.Errorf("got %s, expected only iso and country", out)
+	}
+
+}
+
+// Nested per-family places have their keys remapped once, like the place
+// they're in.
+func TestRemapNestedOnce(t *testing.T) {
+
+	keyRemap = map[string]string{"country_geoname_id": "a", "a": "b"}
+	defer func() { keyRemap = nil }()
+
+	v4 := &place{}
+	v4.CountryGeoNameID = 1
+	p := &place{V4: v4}
+	p.CountryGeoNameID = 2
+
+	j, err := json.Marshal(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out struct {
+		A  uint `json:"a"`
+		V4 struct {
+			A uint `json:"a"`
+		} `json:"v4"`
+	}
+	err = json.Unmarshal(j, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.A != 2 || out.V4.A != 1 {
+		t.Errorf("remapped %s", j)
+	}
+
+}
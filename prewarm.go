@@ -0,0 +1,87 @@
+//
+// Cache prewarming.  GEOIP_PREWARM_FILE lists known-hot addresses, one per
+// line, with # comments.  They're looked up once the databases are open,
+// and again after each reload, so that the first events for them don't pay
+// for a cold cache and unmapped database pages.
+//
+
+package main
+
+import (
+	"bufio"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+// Look up every address in the prewarm file, for each profile in use.  The
+// lock is taken for each lookup, so events are handled meanwhile.
+func (s *work) prewarm() {
+
+	if s.prewarmFile == "" {
+		return
+	}
+
+	f, err := os.Open(s.prewarmFile)
+	if err != nil {
+		utils.Log("Couldn't open prewarm file: %s", err.Error())
+		return
+	}
+	defer f.Close()
+
+	// Cache entries are per profile.
+	profiles := []profile{s.defaultProfile}
+	seen := map[profile]bool{s.defaultProfile: true}
+	for _, p := range s.profiles {
+		if !seen[p] {
+			seen[p] = true
+			profiles = append(profiles, p)
+		}
+	}
+
+	start := time.Now()
+	count := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+
+		addr := strings.TrimSpace(scanner.Text())
+		if addr == "" || strings.HasPrefix(addr, "#") {
+			continue
+		}
+
+		for _, p := range profiles {
+			c, flush := s.passCache(p, addr)
+			s.lock.RLock()
+			s.warm(addr, p, c)
+			s.lock.RUnlock()
+			flush()
+		}
+		count++
+
+	}
+	if err := scanner.Err(); err != nil {
+		utils.Log("Couldn't read prewarm file: %s", err.Error())
+	}
+
+	utils.Log("Prewarmed %d addresses in %s.", count, time.Since(start))
+
+}
+
+// Look up an address into an address cache.  Not counted as an event
+// lookup.  Call with the lock held.
+func (s *work) warm(addr string, p profile, c addrCache) {
+
+	locn, err := s.lookup(addr, p)
+	if c == nil {
+		return
+	}
+	switch {
+	case err == nil:
+		c.put(p.key(addr), locn)
+	case err == ErrNotFound:
+		c.put(p.key(addr), nil)
+	}
+
+}
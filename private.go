@@ -0,0 +1,105 @@
+//
+// Addresses which are never in the GeoIP databases, so aren't looked up:
+// private (RFC1918 and unique local), loopback, link-local, unspecified,
+// reserved (documentation, benchmarking, multicast and the like) and, unless
+// GEOIP_LOOKUP_CGNAT is set, carrier-grade NAT (RFC6598) addresses.
+//
+
+package main
+
+import (
+	"net"
+	"strings"
+)
+
+// Private address ranges.
+var privateNets = parseCIDRs("10.0.0.0/8", "172.16.0.0/12",
+	"192.168.0.0/16", "fc00::/7")
+
+// Documentation and other reserved ranges, which usually mean test or
+// garbage traffic.
+var reservedNets = parseCIDRs(
+
+	// Documentation (RFC5737, RFC3849, RFC9637).
+	"192.0.2.0/24", "198.51.100.0/24", "203.0.113.0/24",
+	"2001:db8::/32", "3fff::/20",
+
+	// "This network", IETF protocol assignments, benchmarking (RFC2544),
+	// reserved class E and broadcast.
+	"0.0.0.0/8", "192.0.0.0/24", "198.18.0.0/15", "240.0.0.0/4",
+
+	// IPv6 discard-only (RFC6666).
+	"100::/64",
+)
+
+// Carrier-grade NAT shared address space.
+var cgnatNet = parseCIDRs("100.64.0.0/10")[0]
+
+// Parse a comma-separated CIDR list from configuration.
+func parseCIDRList(v string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, c := range strings.Split(v, ",") {
+		c = strings.TrimSpace(c)
+		if c == "" {
+			continue
+		}
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+// Whether an address can't have a location.  cgnat is whether CGNAT
+// addresses count.
+func nonRoutable(ip net.IP, cgnat bool) bool {
+
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsUnspecified() {
+		return true
+	}
+
+	for _, n := range privateNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	if reserved(ip) {
+		return true
+	}
+
+	return cgnat && cgnatNet.Contains(ip)
+
+}
+
+// Whether an address is in a documentation or other reserved range.
+func reserved(ip net.IP) bool {
+
+	if ip.IsMulticast() {
+		return true
+	}
+
+	for _, n := range reservedNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+
+}
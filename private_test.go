@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+)
+
+// Addresses either side of each non-routable range's boundaries.
+func TestNonRoutable(t *testing.T) {
+
+	for _, c := range []struct {
+		addr  string
+		cgnat bool
+		want  bool
+	}{
+
+		// RFC1918.
+		{"9.255.255.255", false, false},
+		{"10.0.0.0", false, true},
+		{"10.255.255.255", false, true},
+		{"11.0.0.0", false, false},
+		{"172.15.255.255", false, false},
+		{"172.16.0.0", false, true},
+		{"172.31.255.255", false, true},
+		{"172.32.0.0", false, false},
+		{"192.167.255.255", false, false},
+		{"192.168.0.0", false, true},
+		{"192.168.255.255", false, true},
+		{"192.169.0.0", false, false},
+
+		// Loopback.
+		{"126.255.255.255", false, false},
+		{"127.0.0.0", false, true},
+		{"127.0.0.1", false, true},
+		{"127.255.255.255", false, true},
+		{"128.0.0.0", false, false},
+		{"::1", false, true},
+		{"::2", false, false},
+
+		// Link-local.
+		{"169.253.255.255", false, false},
+		{"169.254.0.0", false, true},
+		{"169.254.255.255", false, true},
+		{"169.255.0.0", false, false},
+		{"fe7f:ffff:ffff:ffff:ffff:ffff:ffff:ffff", false, false},
+		{"fe80::", false, true},
+		{"febf:ffff:ffff:ffff:ffff:ffff:ffff:ffff", false, true},
+		{"fec0::", false, false},
+		{"ff02::1", false, true},
+
+		// Unspecified.
+		{"0.0.0.0", false, true},
+		{"::", false, true},
+
+		// Unique local.
+		{"fbff:ffff:ffff:ffff:ffff:ffff:ffff:ffff", false, false},
+		{"fc00::", false, true},
+		{"fdff:ffff:ffff:ffff:ffff:ffff:ffff:ffff", false, true},
+		{"fe00::", false, false},
+
+		// CGNAT, only when it counts.
+		{"100.63.255.255", true, false},
+		{"100.64.0.0", true, true},
+		{"100.64.0.0", false, false},
+		{"100.127.255.255", true, true},
+		{"100.127.255.255", false, false},
+		{"100.128.0.0", true, false},
+
+		// IPv4-mapped private address.
+		{"::ffff:10.0.0.1", false, true},
+
+		// Public.
+		{"8.8.8.8", true, false},
+		{"2001:4860:4860::8888", true, false},
+	} {
+		got := nonRoutable(net.ParseIP(c.addr), c.cgnat)
+		if got != c.want {
+			t.Errorf("nonRoutable(%s, %v) = %v, expected %v", c.addr,
+				c.cgnat, got, c.want)
+		}
+	}
+
+}
+
+// CGNAT addresses aren't looked up unless GEOIP_LOOKUP_CGNAT is set, even
+// when the database maps them.
+func TestLookupCGNAT(t *testing.T) {
+
+	dir, cleanup := testDir(t)
+	defer cleanup()
+
+	env := map[string]string{
+		"GEOIP_DB": testDB(t, dir, "city.mmdb", "GeoLite2-City", 1,
+			[]testNetwork{{"100.64.0.0/10",
+				testCityRecord("GB", "United Kingdom", "Leeds")}}),
+		"GEOIP_ASN_DB": testDB(t, dir, "asn.mmdb", "GeoLite2-ASN", 1,
+			nil),
+	}
+
+	for _, c := range []struct {
+		lookupCGNAT string
+		want        error
+	}{
+		{"false", ErrNotFound},
+		{"true", nil},
+	} {
+
+		env["GEOIP_LOOKUP_CGNAT"] = c.lookupCGNAT
+		s, closeDBs := testWork(t, env)
+
+		s.lock.RLock()
+		locn, err := s.lookup("100.100.1.1", s.defaultProfile)
+		s.lock.RUnlock()
+		closeDBs()
+
+		if errorKind(err) != c.want {
+			t.Errorf("GEOIP_LOOKUP_CGNAT=%s: error %v, expected %v",
+				c.lookupCGNAT, err, c.want)
+		}
+		if err == nil && locn.City != "Leeds" {
+			t.Errorf("GEOIP_LOOKUP_CGNAT=%s: got %+v", c.lookupCGNAT, locn)
+		}
+
+	}
+
+}
+
+// Addresses either side of each documentation range.
+func TestReservedDocumentationRanges(t *testing.T) {
+
+	for _, c := range []struct {
+		addr string
+		want bool
+	}{
+		{"192.0.1.255", false},
+		{"192.0.2.0", true},
+		{"192.0.2.255", true},
+		{"192.0.3.0", false},
+		{"198.51.99.255", false},
+		{"198.51.100.0", true},
+		{"198.51.100.255", true},
+		{"198.51.101.0", false},
+		{"203.0.112.255", false},
+		{"203.0.113.0", true},
+		{"203.0.113.255", true},
+		{"203.0.114.0", false},
+		{"2001:db7:ffff:ffff:ffff:ffff:ffff:ffff", false},
+		{"2001:db8::", true},
+		{"2001:db8:ffff:ffff:ffff:ffff:ffff:ffff", true},
+		{"2001:db9::", false},
+		{"3ffe:ffff:ffff:ffff:ffff:ffff:ffff:ffff", false},
+		{"3fff::", true},
+		{"3fff:fff:ffff:ffff:ffff:ffff:ffff:ffff", true},
+		{"3fff:1000::", false},
+	} {
+		ip := net.ParseIP(c.addr)
+		if got := reserved(ip); got != c.want {
+			t.Errorf("reserved(%s) = %v, expected %v", c.addr, got, c.want)
+		}
+		if got := nonRoutable(ip, true); got != c.want {
+			t.Errorf("nonRoutable(%s) = %v, expected %v", c.addr, got,
+				c.want)
+		}
+	}
+
+}
+
+// Events with a documentation address in either direction are tagged,
+// and the address isn't looked up.
+func TestTagReserved(t *testing.T) {
+
+	dir, cleanup := testDir(t)
+	defer cleanup()
+
+	env := testDBEnv(t, dir)
+	env["GEOIP_TAG_RESERVED"] = "true"
+	s, closeDBs := testWork(t, env)
+	defer closeDBs()
+
+	for _, c := range []struct {
+		msg  string
+		want bool
+	}{
+		{`{"src":["ipv4:192.0.2.1"],"dest":["ipv4:1.2.3.4"]}`, true},
+		{`{"src":["ipv4:1.2.3.4"],"dest":["ipv4:198.51.100.1"]}`, true},
+		{`{"src":["ipv4:203.0.113.9"]}`, true},
+		{`{"src":["ipv6:2001:db8::1"]}`, true},
+		{`{"src":["ipv6:3fff::1"]}`, true},
+		{`{"src":["ipv4:1.2.3.4"],"dest":["ipv4:1.2.3.5"]}`, false},
+	} {
+		var ev event
+		out := testHandle(t, s, c.msg)
+		err := json.Unmarshal(out, &ev)
+		if err != nil {
+			t.Fatalf("bad output %s: %s", out, err.Error())
+		}
+		if ev.IsReserved != c.want {
+			t.Errorf("%s: is_reserved %v, expected %v", c.msg,
+				ev.IsReserved, c.want)
+		}
+		if ev.Location != nil && ev.Location.Src != nil &&
+			ev.Location.Src.ASNum != 64500 {
+			t.Errorf("%s: documentation address located: %s", c.msg, out)
+		}
+	}
+
+}
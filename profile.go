@@ -0,0 +1,104 @@
+//
+// Enrichment profiles, chosen by event action, so that events which only
+// need coarse data don't pay for full enrichment.  GEOIP_PROFILES maps
+// actions to profiles, e.g.
+//
+//   dns_message=country,http_request=city+asn+anon
+//
+// A profile is a "+"-separated list of parts.  The country is always looked
+// up; "city" adds the city-level fields, "asn" the ASN fields and RIR, "isp"
+// the ISP fields, and "anon" the anonymous-IP flags.  "full" is all of them,
+// and is the profile for actions not listed, unless GEOIP_DEFAULT_PROFILE
+// says otherwise.
+//
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Parts of an enrichment, as a bit set.
+type profile uint
+
+const (
+	profileCity profile = 1 << iota
+	profileASN
+	profileISP
+	profileAnon
+)
+
+const (
+	countryProfile profile = 0
+	fullProfile            = profileCity | profileASN | profileISP |
+		profileAnon
+)
+
+var profileParts = map[string]profile{
+	"country": countryProfile,
+	"city":    profileCity,
+	"asn":     profileASN,
+	"isp":     profileISP,
+	"anon":    profileAnon,
+	"full":    fullProfile,
+}
+
+// Parse a profile, e.g. "city+asn".
+func parseProfile(v string) (profile, error) {
+	var p profile
+	for _, part := range strings.Split(v, "+") {
+		b, ok := profileParts[strings.TrimSpace(part)]
+		if !ok {
+			return 0, fmt.Errorf("unknown profile part: %s", part)
+		}
+		p |= b
+	}
+	return p, nil
+}
+
+// Parse the action to profile map.
+func parseProfiles(v string) (map[string]profile, error) {
+
+	profiles := map[string]profile{}
+	for _, ent := range strings.Split(v, ",") {
+
+		ent = strings.TrimSpace(ent)
+		if ent == "" {
+			continue
+		}
+
+		kv := strings.SplitN(ent, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return nil, fmt.Errorf("expected action=profile: %s", ent)
+		}
+
+		p, err := parseProfile(kv[1])
+		if err != nil {
+			return nil, err
+		}
+		profiles[strings.TrimSpace(kv[0])] = p
+
+	}
+
+	return profiles, nil
+
+}
+
+// Profile for an event action.
+func (s *work) profileFor(action string) profile {
+	if p, ok := s.profiles[action]; ok {
+		return p
+	}
+	return s.defaultProfile
+}
+
+// Cache key for an address, or address pair, under a profile.  Full
+// enrichment keeps the plain key.
+func (p profile) key(k string) string {
+	if p == fullProfile {
+		return k
+	}
+	return k + "#" + strconv.Itoa(int(p))
+}
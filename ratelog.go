@@ -0,0 +1,86 @@
+//
+// Rate-limited logging.  The first occurrence of a message is logged
+// straight away; repeats within the window are counted and summarised as
+// "N occurrences in the last ..." when the window closes.  Messages are
+// repeats if they have the same format, whatever the arguments, so an error
+// which quotes each event's data is still limited; the summary shows the
+// latest one.  This keeps the log usable when every event hits the same
+// error.
+//
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+type rateLogEntry struct {
+	start time.Time
+	count int
+
+	// Latest message.
+	msg string
+}
+
+type rateLog struct {
+	lock   sync.Mutex
+	window time.Duration
+
+	// Entries by format.
+	msgs map[string]*rateLogEntry
+}
+
+// Create a rate-limited log, and start the goroutine which summarises
+// repeats at the end of each window.
+func newRateLog(window time.Duration) *rateLog {
+	r := &rateLog{window: window, msgs: map[string]*rateLogEntry{}}
+	go r.flusher()
+	return r
+}
+
+// Log a message, unless it has already been logged in this window.
+func (r *rateLog) log(format string, args ...interface{}) {
+
+	msg := fmt.Sprintf(format, args...)
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if ent, ok := r.msgs[format]; ok {
+		ent.count++
+		ent.msg = msg
+		return
+	}
+
+	r.msgs[format] = &rateLogEntry{start: time.Now(), count: 1, msg: msg}
+	utils.Log("%s", msg)
+
+}
+
+// Goroutine: summarise and forget messages whose window has closed.
+func (r *rateLog) flusher() {
+
+	for {
+
+		time.Sleep(r.window / 4)
+
+		r.lock.Lock()
+		for format, ent := range r.msgs {
+			if time.Since(ent.start) < r.window {
+				continue
+			}
+			if ent.count > 1 {
+				utils.Log("%s (%d occurrences in the last %s)", ent.msg,
+					ent.count, r.window)
+			}
+			delete(r.msgs, format)
+		}
+		r.lock.Unlock()
+
+	}
+
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// Messages with the same format are repeats, whatever the arguments.
+func TestRateLogKeyedByFormat(t *testing.T) {
+
+	r := &rateLog{window: time.Minute, msgs: map[string]*rateLogEntry{}}
+
+	r.log("Lookup error: %s", "bad record 1")
+	r.log("Lookup error: %s", "bad record 2")
+	r.log("Lookup error: %s", "bad record 3")
+	r.log("Couldn't unmarshal json: %s", "unexpected EOF")
+
+	if len(r.msgs) != 2 {
+		t.Fatalf("%d entries, expected 2", len(r.msgs))
+	}
+
+	ent := r.msgs["Lookup error: %s"]
+	if ent == nil {
+		t.Fatal("no entry for the lookup error format")
+	}
+	if ent.count != 3 {
+		t.Errorf("count %d, expected 3", ent.count)
+	}
+	if ent.msg != "Lookup error: bad record 3" {
+		t.Errorf("latest message %q", ent.msg)
+	}
+
+}
@@ -0,0 +1,412 @@
+//
+// Settings file and runtime reconfiguration.  GEOIP_CONFIG_FILE names a file
+// of KEY=VALUE lines, which override the environment.  On SIGHUP the file is
+// read again, and the runtime settings below applied without a restart;
+// changes to anything else are logged as needing one.  A runtime setting
+// taken out of the file goes back to its environment value.
+//
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/trustnetworks/analytics-common/utils"
+)
+
+// Settings which can be changed without a restart.  They're parsed by
+// initRuntime and copied over by applyRuntime.
+var runtimeSettings = map[string]bool{
+	"GEOIP_LOCALES":            true,
+	"GEOIP_COUNTRY_METADATA":   true,
+	"GEOIP_PRECISION":          true,
+	"GEOIP_PRECISION_EXACT_KM": true,
+	"GEOIP_GEONAME_IDS":        true,
+	"GEOIP_FLAG_EMOJI":         true,
+	"GEOIP_ISO3":               true,
+	"GEOIP_STATIC_IP_SCORE":    true,
+	"GEOIP_TIME_ZONE":          true,
+	"GEOIP_UTC_OFFSET":         true,
+	"GEOIP_GEOJSON":            true,
+	"GEOIP_ACCURACY_UNIT":      true,
+	"GEOIP_ACCURACY_DECIMALS":  true,
+	"GEOIP_GEOHASH_PRECISION":  true,
+	"GEOIP_TAG_RESERVED":       true,
+	"GEOIP_EMIT_BOTH":          true,
+	"GEOIP_RISK_SCORE":         true,
+	"GEOIP_RISK_WEIGHTS":       true,
+	"GEOIP_DUAL_STACK":         true,
+	"GEOIP_MERGE_LOCATION":     true,
+	"GEOIP_ENRICHMENT_TIME":    true,
+	"GEOIP_SAMPLE_RATE":        true,
+	"GEOIP_CACHE_SIZE":         true,
+	"GEOIP_FLOW_CACHE_SIZE":    true,
+}
+
+// Read a settings file.
+func readConfigFile(filename string) (map[string]string, error) {
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	vals := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return nil, fmt.Errorf("%s:%d: expected KEY=VALUE", filename, n)
+		}
+		vals[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+
+	}
+
+	return vals, scanner.Err()
+
+}
+
+// Load the settings file, if there is one, into the environment, and start
+// reloading it on SIGHUP.
+func (s *work) initConfigFile() error {
+
+	s.configFile = utils.Getenv("GEOIP_CONFIG_FILE", "")
+	if s.configFile == "" {
+		return nil
+	}
+
+	// Environment values of the runtime settings, for settings later
+	// taken out of the file.
+	s.baseEnv = map[string]string{}
+	for k := range runtimeSettings {
+		if v, ok := os.LookupEnv(k); ok {
+			s.baseEnv[k] = v
+		}
+	}
+
+	vals, err := readConfigFile(s.configFile)
+	if err != nil {
+		return fmt.Errorf("GEOIP_CONFIG_FILE: %s", err.Error())
+	}
+	for k, v := range vals {
+		os.Setenv(k, v)
+	}
+	s.configValues = vals
+
+	go s.reloadOnHangup()
+
+	return nil
+
+}
+
+// Goroutine: reload the settings file on SIGHUP.
+func (s *work) reloadOnHangup() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		s.reloadConfig()
+	}
+}
+
+// Read the settings file again, and apply changed runtime settings.
+func (s *work) reloadConfig() {
+
+	utils.Log("Reloading configuration from %s.", s.configFile)
+
+	vals, err := readConfigFile(s.configFile)
+	if err != nil {
+		utils.Log("Config reload failed, settings unchanged: %s",
+			err.Error())
+		return
+	}
+
+	// Log what changed, in a stable order.
+	keys := []string{}
+	for k := range vals {
+		keys = append(keys, k)
+	}
+	for k := range s.configValues {
+		if _, ok := vals[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	changed := false
+	for _, k := range keys {
+		old, hadOld := s.configValues[k]
+		cur, hasCur := vals[k]
+		if hadOld == hasCur && old == cur {
+			continue
+		}
+		if !runtimeSettings[k] {
+			utils.Log("Config: %s changed, restart to apply it", k)
+			continue
+		}
+		if !hadOld {
+			old = s.baseEnv[k]
+		}
+		if !hasCur {
+			cur = s.baseEnv[k]
+		}
+		utils.Log("Config: %s changed: %q -> %q", k, old, cur)
+		changed = true
+	}
+
+	if !changed {
+		s.configValues = vals
+		utils.Log("No runtime settings changed.")
+		return
+	}
+
+	// Runtime settings come from the file, or the original environment.
+	for k := range runtimeSettings {
+		if v, ok := vals[k]; ok {
+			os.Setenv(k, v)
+		} else if v, ok := s.baseEnv[k]; ok {
+			os.Setenv(k, v)
+		} else {
+			os.Unsetenv(k)
+		}
+	}
+
+	var n work
+	err = n.initRuntime()
+	if err != nil {
+		utils.Log("Config reload failed, settings unchanged: %s",
+			err.Error())
+		return
+	}
+
+	// Wait for events in progress, and keep lookups out, while swapping.
+	s.active.Lock()
+	s.lock.Lock()
+	s.applyRuntime(&n)
+	s.configValues = vals
+
+	// Cached locations were made with the old settings.  Caches take
+	// their new sizes, but one which wasn't made at startup needs a
+	// restart.
+	if s.cache != nil {
+		s.cache.purge()
+	} else if s.cacheSize > 0 && s.redisCache == nil {
+		utils.Log("Config: GEOIP_CACHE_SIZE enables the cache, restart " +
+			"to apply it")
+	}
+	// Shared Redis entries are keyed by the settings instead.
+	if r := s.redisCache; r != nil {
+		r.digest = s.placeDigest(r.startup)
+	}
+	if s.flowCache != nil {
+		s.flowCache.purge()
+	} else if s.flowCacheSize > 0 {
+		utils.Log("Config: GEOIP_FLOW_CACHE_SIZE enables the flow cache, " +
+			"restart to apply it")
+	}
+	// Cut as far as the memory guard has cut them.
+	s.resizeCaches()
+	s.lock.Unlock()
+	s.active.Unlock()
+
+	utils.Log("Configuration reloaded.")
+
+}
+
+// Parse the runtime settings.
+func (s *work) initRuntime() error {
+
+	var err error
+
+	// Name locales.
+	s.locales = strings.Split(utils.Getenv("GEOIP_LOCALES", "en"), ",")
+	for i := range s.locales {
+		s.locales[i] = strings.TrimSpace(s.locales[i])
+	}
+
+	// Country calling code and currency.
+	s.countryMetadata, err = getenvBool("GEOIP_COUNTRY_METADATA", false)
+	if err != nil {
+		return err
+	}
+
+	// Precision level.
+	s.precision, err = getenvBool("GEOIP_PRECISION", false)
+	if err != nil {
+		return err
+	}
+	s.exactRadiusKm, err = getenvInt("GEOIP_PRECISION_EXACT_KM", 5)
+	if err != nil {
+		return err
+	}
+
+	// GeoNames IDs of the city, country and subdivision.
+	s.geoNameIDs, err = getenvBool("GEOIP_GEONAME_IDS", false)
+	if err != nil {
+		return err
+	}
+
+	// Country flag emoji.
+	s.flagEmoji, err = getenvBool("GEOIP_FLAG_EMOJI", false)
+	if err != nil {
+		return err
+	}
+
+	// Alpha-3 country code.
+	s.alpha3, err = getenvBool("GEOIP_ISO3", false)
+	if err != nil {
+		return err
+	}
+
+	// Enterprise static IP score.
+	s.staticIPScore, err = getenvBool("GEOIP_STATIC_IP_SCORE", false)
+	if err != nil {
+		return err
+	}
+
+	// Time zone, and UTC offset, which needs the time zone.
+	s.timeZone, err = getenvBool("GEOIP_TIME_ZONE", false)
+	if err != nil {
+		return err
+	}
+	s.utcOffset, err = getenvBool("GEOIP_UTC_OFFSET", false)
+	if err != nil {
+		return err
+	}
+	if s.utcOffset {
+		s.timeZone = true
+	}
+
+	// GeoJSON position output.
+	s.geoJSON = utils.Getenv("GEOIP_GEOJSON", "")
+	if s.geoJSON != "" && s.geoJSON != "add" && s.geoJSON != "replace" {
+		return fmt.Errorf("GEOIP_GEOJSON: unknown mode: %s", s.geoJSON)
+	}
+
+	// Accuracy radius unit.
+	s.accuracyUnit = utils.Getenv("GEOIP_ACCURACY_UNIT", "km")
+	if _, ok := accuracyUnits[s.accuracyUnit]; !ok {
+		return fmt.Errorf("GEOIP_ACCURACY_UNIT: unknown unit: %s",
+			s.accuracyUnit)
+	}
+	s.accuracyDecimals, err = getenvInt("GEOIP_ACCURACY_DECIMALS", 1)
+	if err != nil {
+		return err
+	}
+	if s.accuracyDecimals < 0 {
+		return fmt.Errorf("GEOIP_ACCURACY_DECIMALS: must not be negative")
+	}
+
+	// Geohash of the position.
+	s.geohashPrecision, err = getenvInt("GEOIP_GEOHASH_PRECISION", 0)
+	if err != nil {
+		return err
+	}
+	if s.geohashPrecision < 0 || s.geohashPrecision > 12 {
+		return fmt.Errorf("GEOIP_GEOHASH_PRECISION: must be 0 to 12")
+	}
+
+	// Reserved address flag.
+	s.tagReserved, err = getenvBool("GEOIP_TAG_RESERVED", false)
+	if err != nil {
+		return err
+	}
+
+	// Flat location fields as well as the location object.
+	s.emitBoth, err = getenvBool("GEOIP_EMIT_BOTH", false)
+	if err != nil {
+		return err
+	}
+
+	// Risk score.
+	riskScore, err := getenvBool("GEOIP_RISK_SCORE", false)
+	if err != nil {
+		return err
+	}
+	if riskScore {
+		s.riskWeights, err = parseRiskWeights(
+			utils.Getenv("GEOIP_RISK_WEIGHTS", ""))
+		if err != nil {
+			return fmt.Errorf("GEOIP_RISK_WEIGHTS: %s", err.Error())
+		}
+	}
+
+	// Both families of dual-stack endpoints.
+	s.dualStack, err = getenvBool("GEOIP_DUAL_STACK", false)
+	if err != nil {
+		return err
+	}
+
+	// Merging with an upstream location.
+	s.mergeLocation, err = getenvBool("GEOIP_MERGE_LOCATION", false)
+	if err != nil {
+		return err
+	}
+
+	// Enrichment timestamp.
+	s.stampTime, err = getenvBool("GEOIP_ENRICHMENT_TIME", false)
+	if err != nil {
+		return err
+	}
+
+	// Sampling.
+	s.sampleRate, err = getenvFloat("GEOIP_SAMPLE_RATE", 1.0)
+	if err != nil {
+		return err
+	}
+	if s.sampleRate < 0.0 || s.sampleRate > 1.0 {
+		return fmt.Errorf("GEOIP_SAMPLE_RATE: must be 0.0 to 1.0")
+	}
+
+	// Address and flow cache sizes.
+	s.cacheSize, err = getenvInt("GEOIP_CACHE_SIZE", 0)
+	if err != nil {
+		return err
+	}
+	s.flowCacheSize, err = getenvInt("GEOIP_FLOW_CACHE_SIZE", 0)
+	if err != nil {
+		return err
+	}
+
+	return nil
+
+}
+
+// Copy runtime settings from another configuration.
+func (s *work) applyRuntime(n *work) {
+	s.locales = n.locales
+	s.countryMetadata = n.countryMetadata
+	s.precision = n.precision
+	s.exactRadiusKm = n.exactRadiusKm
+	s.geoNameIDs = n.geoNameIDs
+	s.flagEmoji = n.flagEmoji
+	s.alpha3 = n.alpha3
+	s.staticIPScore = n.staticIPScore
+	s.timeZone = n.timeZone
+	s.utcOffset = n.utcOffset
+	s.geoJSON = n.geoJSON
+	s.accuracyUnit = n.accuracyUnit
+	s.accuracyDecimals = n.accuracyDecimals
+	s.geohashPrecision = n.geohashPrecision
+	s.tagReserved = n.tagReserved
+	s.emitBoth = n.emitBoth
+	s.riskWeights = n.riskWeights
+	s.dualStack = n.dualStack
+	s.mergeLocation = n.mergeLocation
+	s.stampTime = n.stampTime
+	s.sampleRate = n.sampleRate
+	s.cacheSize = n.cacheSize
+	s.flowCacheSize = n.flowCacheSize
+}
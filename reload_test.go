@@ -0,0 +1,113 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// A config reload resizes the caches, evicting down to the new sizes.
+func TestReloadCacheSize(t *testing.T) {
+
+	dir, cleanup := testDir(t)
+	defer cleanup()
+
+	// Puts back whatever the reload sets.
+	defer setTestEnv(map[string]string{
+		"GEOIP_CACHE_SIZE":      "",
+		"GEOIP_FLOW_CACHE_SIZE": "",
+	})()
+
+	file := filepath.Join(dir, "geoip.conf")
+	err := ioutil.WriteFile(file,
+		[]byte("GEOIP_CACHE_SIZE=2\nGEOIP_FLOW_CACHE_SIZE=0\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &work{
+		configFile:   file,
+		configValues: map[string]string{},
+		baseEnv:      map[string]string{},
+		cache:        newLRU(10, 0),
+		flowCache:    newLRU(10, time.Minute),
+	}
+	for _, k := range []string{"a", "b", "c", "d"} {
+		s.cache.put(k, k)
+		s.flowCache.put(k, k)
+	}
+
+	s.reloadConfig()
+
+	if s.cacheSize != 2 || s.flowCacheSize != 0 {
+		t.Fatalf("sizes %d and %d, expected 2 and 0", s.cacheSize,
+			s.flowCacheSize)
+	}
+	for _, k := range []string{"a", "b", "c", "d"} {
+		s.cache.put(k, k)
+		s.flowCache.put(k, k)
+	}
+	if n := s.cache.len(); n != 2 {
+		t.Errorf("cache holds %d entries, expected 2", n)
+	}
+	if n := s.flowCache.len(); n != 0 {
+		t.Errorf("flow cache holds %d entries, expected 0", n)
+	}
+
+}
+
+// A config reload while the memory guard has cut the caches keeps them cut,
+// and they go back to the reloaded sizes once memory is freed.
+func TestReloadCacheSizeGuarded(t *testing.T) {
+
+	dir, cleanup := testDir(t)
+	defer cleanup()
+
+	defer setTestEnv(map[string]string{
+		"GEOIP_CACHE_SIZE":      "",
+		"GEOIP_FLOW_CACHE_SIZE": "",
+	})()
+
+	file := filepath.Join(dir, "geoip.conf")
+	err := ioutil.WriteFile(file,
+		[]byte("GEOIP_CACHE_SIZE=8\nGEOIP_FLOW_CACHE_SIZE=4\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &work{
+		configFile:    file,
+		configValues:  map[string]string{},
+		baseEnv:       map[string]string{},
+		cacheSize:     10,
+		flowCacheSize: 10,
+		cache:         newLRU(10, 0),
+		flowCache:     newLRU(10, time.Minute),
+	}
+
+	// Over the limit, halved.
+	s.checkMemory(2, 1)
+	s.reloadConfig()
+
+	fill := func() {
+		for i := 0; i < 20; i++ {
+			k := string(rune('a' + i))
+			s.cache.put(k, k)
+			s.flowCache.put(k, k)
+		}
+	}
+	fill()
+	if n, m := s.cache.len(), s.flowCache.len(); n != 4 || m != 2 {
+		t.Errorf("after reload caches hold %d and %d, expected 4 and 2",
+			n, m)
+	}
+
+	// Under half the limit, restored to the reloaded sizes.
+	s.checkMemory(0, 4)
+	fill()
+	if n, m := s.cache.len(), s.flowCache.len(); n != 8 || m != 4 {
+		t.Errorf("restored caches hold %d and %d, expected 8 and 4", n, m)
+	}
+
+}
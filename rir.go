@@ -0,0 +1,318 @@
+//
+// Regional Internet Registry responsible for an ASN or address.  Comes from
+// RIR statistics exchange ("delegated-*") files, with bundled tables from
+// IANA's registries as a fallback: the IPv4 /8s, IPv6 /12 blocks and ASN
+// blocks IANA has allocated to each RIR.  A legacy IPv4 /8 counts for the
+// RIR which administers it.  The bundled tables are coarse, so don't follow
+// transfers between RIRs, and leave out IANA's smaller IPv6 allocations
+// (mostly in 2001::/16 and 2003::/18): without delegation files, addresses
+// in those have no RIR.  Registry names are as they appear in the files:
+// "afrinic", "apnic", "arin", "lacnic", "ripencc".
+//
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// IPv6 /12 blocks allocated to each RIR by IANA.  Not the smaller
+// allocations.
+var rirIPv6Blocks = map[string]string{
+	"2400::/12": "apnic",
+	"2600::/12": "arin",
+	"2800::/12": "lacnic",
+	"2a00::/12": "ripencc",
+	"2a10::/12": "ripencc",
+	"2c00::/12": "afrinic",
+}
+
+// IPv4 /8s, by first octet, allocated to or administered by each RIR,
+// from IANA's IPv4 address space registry.
+var rirIPv4Blocks = map[string][]int{
+	"afrinic": {41, 102, 105, 154, 196, 197},
+	"apnic": {1, 14, 27, 36, 39, 42, 43, 49, 58, 59, 60, 61, 101, 103,
+		106, 110, 111, 112, 113, 114, 115, 116, 117, 118, 119, 120, 121,
+		122, 123, 124, 125, 126, 133, 150, 153, 163, 171, 175, 180, 182,
+		183, 202, 203, 210, 211, 218, 219, 220, 221, 222, 223},
+	"arin": {3, 4, 6, 7, 8, 9, 11, 12, 13, 15, 16, 17, 18, 19, 20, 21,
+		22, 23, 24, 26, 28, 29, 30, 32, 33, 34, 35, 38, 40, 44, 45, 47, 48,
+		50, 52, 54, 55, 56, 63, 64, 65, 66, 67, 68, 69, 70, 71, 72, 73,
+		74, 75, 76, 96, 97, 98, 99, 100, 104, 107, 108, 128, 129, 130,
+		131, 132, 134, 135, 136, 137, 138, 139, 140, 142, 143, 144, 146,
+		147, 148, 149, 152, 155, 156, 157, 158, 159, 160, 161, 162, 164,
+		165, 166, 167, 168, 169, 170, 172, 173, 174, 184, 192, 198, 199,
+		204, 205, 206, 207, 208, 209, 214, 215, 216},
+	"lacnic": {177, 179, 181, 186, 187, 189, 190, 191, 200, 201},
+	"ripencc": {2, 5, 25, 31, 37, 46, 51, 53, 57, 62, 77, 78, 79, 80,
+		81, 82, 83, 84, 85, 86, 87, 88, 89, 90, 91, 92, 93, 94, 95, 109,
+		141, 145, 151, 176, 178, 185, 188, 193, 194, 195, 212, 213, 217},
+}
+
+// ASN blocks assigned to each RIR, from IANA's AS numbers registry.  The
+// 16-bit blocks are IANA's; 32-bit ASNs are given as the region each RIR's
+// blocks are allocated from.  AS_TRANS (23456) and the reserved,
+// documentation and private ASNs aren't in any.
+var rirASNBlocks = []asnRange{
+	{1, 1876, "arin"},
+	{1877, 1901, "ripencc"},
+	{1902, 2042, "arin"},
+	{2043, 2043, "ripencc"},
+	{2044, 2046, "arin"},
+	{2047, 2047, "ripencc"},
+	{2048, 2106, "arin"},
+	{2107, 2136, "ripencc"},
+	{2137, 2584, "arin"},
+	{2585, 2614, "ripencc"},
+	{2615, 2772, "arin"},
+	{2773, 2822, "ripencc"},
+	{2823, 2829, "arin"},
+	{2830, 2879, "ripencc"},
+	{2880, 3153, "arin"},
+	{3154, 3353, "ripencc"},
+	{3354, 4607, "arin"},
+	{4608, 4865, "apnic"},
+	{4866, 5376, "arin"},
+	{5377, 5631, "ripencc"},
+	{5632, 6655, "arin"},
+	{6656, 6911, "ripencc"},
+	{6912, 7466, "arin"},
+	{7467, 7722, "apnic"},
+	{7723, 8191, "arin"},
+	{8192, 9215, "ripencc"},
+	{9216, 10239, "apnic"},
+	{10240, 12287, "arin"},
+	{12288, 13311, "ripencc"},
+	{13312, 15359, "arin"},
+	{15360, 16383, "ripencc"},
+	{16384, 17407, "arin"},
+	{17408, 18431, "apnic"},
+	{18432, 20479, "arin"},
+	{20480, 21503, "ripencc"},
+	{21504, 23455, "arin"},
+	{23457, 23551, "arin"},
+	{23552, 24575, "apnic"},
+	{24576, 25599, "ripencc"},
+	{25600, 26591, "arin"},
+	{26592, 26623, "lacnic"},
+	{26624, 27647, "arin"},
+	{27648, 28671, "lacnic"},
+	{28672, 29695, "ripencc"},
+	{29696, 30719, "arin"},
+	{30720, 31743, "ripencc"},
+	{31744, 33791, "arin"},
+	{33792, 35839, "ripencc"},
+	{35840, 36863, "arin"},
+	{36864, 37887, "afrinic"},
+	{37888, 38911, "apnic"},
+	{38912, 39935, "ripencc"},
+	{39936, 40959, "arin"},
+	{40960, 45055, "ripencc"},
+	{45056, 46079, "apnic"},
+	{46080, 47103, "arin"},
+	{47104, 52223, "ripencc"},
+	{52224, 53247, "lacnic"},
+	{53248, 55295, "arin"},
+	{55296, 56319, "apnic"},
+	{56320, 58367, "ripencc"},
+	{58368, 59391, "apnic"},
+	{59392, 61439, "ripencc"},
+	{61440, 61951, "lacnic"},
+	{61952, 62463, "ripencc"},
+	{62464, 63487, "arin"},
+	{131072, 196607, "apnic"},
+	{196608, 262143, "ripencc"},
+	{262144, 327679, "lacnic"},
+	{327680, 393215, "afrinic"},
+	{393216, 458751, "arin"},
+}
+
+// Range of ASNs delegated by an RIR.
+type asnRange struct {
+	start, end uint32
+	rir        string
+}
+
+// Range of addresses delegated by an RIR, in 16-byte form.
+type addrRange struct {
+	start, end net.IP
+	rir        string
+}
+
+// Delegations, each list sorted by start.  Ranges from files are more
+// specific than, and overlap, the bundled blocks, so those are kept apart
+// as fallbacks.
+type rirTable struct {
+	asns        []asnRange
+	addrs       []addrRange
+	asnFallback []asnRange
+	fallback    []addrRange
+}
+
+// Load RIR delegations from statistics files, e.g.
+// delegated-ripencc-extended-latest.  With no files, only the bundled
+// blocks are used.
+func loadRIR(filenames []string) (*rirTable, error) {
+
+	t := &rirTable{}
+	for _, filename := range filenames {
+		err := t.load(filename)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for rir, octets := range rirIPv4Blocks {
+		for _, o := range octets {
+			t.fallback = append(t.fallback, addrRange{
+				net.IPv4(byte(o), 0, 0, 0).To16(),
+				net.IPv4(byte(o), 255, 255, 255).To16(), rir})
+		}
+	}
+	for cidr, rir := range rirIPv6Blocks {
+		_, n, _ := net.ParseCIDR(cidr)
+		t.fallback = append(t.fallback, ipv6Range(n, rir))
+	}
+	t.asnFallback = rirASNBlocks
+
+	sort.Slice(t.asns, func(i, j int) bool {
+		return t.asns[i].start < t.asns[j].start
+	})
+	sortAddrRanges(t.addrs)
+	sortAddrRanges(t.fallback)
+
+	return t, nil
+
+}
+
+// Load one statistics file.  Lines are
+// "registry|cc|type|start|value|date|status[|...]", where value is an
+// address count for IPv4, a prefix length for IPv6, and an ASN count for
+// ASNs.  Version and summary lines, and unallocated entries, are skipped.
+func (t *rirTable) load(filename string) error {
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		rec := strings.Split(line, "|")
+		if len(rec) < 7 {
+			continue
+		}
+		if rec[6] != "allocated" && rec[6] != "assigned" {
+			continue
+		}
+
+		rir := rec[0]
+		value, err := strconv.ParseUint(rec[4], 10, 32)
+		if err != nil {
+			return fmt.Errorf("%s:%d: bad value: %s", filename, n, rec[4])
+		}
+
+		switch rec[2] {
+
+		case "asn":
+			start, err := strconv.ParseUint(rec[3], 10, 32)
+			if err != nil || value == 0 {
+				return fmt.Errorf("%s:%d: bad ASN range", filename, n)
+			}
+			t.asns = append(t.asns, asnRange{uint32(start),
+				uint32(start + value - 1), rir})
+
+		case "ipv4":
+			ip := net.ParseIP(rec[3]).To4()
+			if ip == nil || value == 0 {
+				return fmt.Errorf("%s:%d: bad IPv4 range", filename, n)
+			}
+			start := uint64(binary.BigEndian.Uint32(ip))
+			if start+value-1 > 0xffffffff {
+				return fmt.Errorf("%s:%d: bad IPv4 range", filename, n)
+			}
+			end := make(net.IP, net.IPv4len)
+			binary.BigEndian.PutUint32(end, uint32(start+value-1))
+			t.addrs = append(t.addrs, addrRange{ip.To16(), end.To16(), rir})
+
+		case "ipv6":
+			_, n6, err := net.ParseCIDR(rec[3] + "/" + rec[4])
+			if err != nil || n6.IP.To4() != nil {
+				return fmt.Errorf("%s:%d: bad IPv6 range", filename, n)
+			}
+			t.addrs = append(t.addrs, ipv6Range(n6, rir))
+
+		}
+
+	}
+
+	return scanner.Err()
+
+}
+
+// Address range of an IPv6 network.
+func ipv6Range(n *net.IPNet, rir string) addrRange {
+	end := make(net.IP, net.IPv6len)
+	for i := range end {
+		end[i] = n.IP[i] | ^n.Mask[i]
+	}
+	return addrRange{n.IP, end, rir}
+}
+
+func sortAddrRanges(r []addrRange) {
+	sort.Slice(r, func(i, j int) bool {
+		return bytes.Compare(r[i].start, r[j].start) < 0
+	})
+}
+
+// RIR for an ASN, or empty.
+func (t *rirTable) lookupASN(asn uint) string {
+	if rir := searchASNRanges(t.asns, asn); rir != "" {
+		return rir
+	}
+	return searchASNRanges(t.asnFallback, asn)
+}
+
+func searchASNRanges(r []asnRange, asn uint) string {
+	i := sort.Search(len(r), func(i int) bool {
+		return uint(r[i].start) > asn
+	})
+	if i > 0 && uint(r[i-1].end) >= asn {
+		return r[i-1].rir
+	}
+	return ""
+}
+
+// RIR for an address, or empty.
+func (t *rirTable) lookupAddr(ip net.IP) string {
+	ip = ip.To16()
+	if rir := searchAddrRanges(t.addrs, ip); rir != "" {
+		return rir
+	}
+	return searchAddrRanges(t.fallback, ip)
+}
+
+func searchAddrRanges(r []addrRange, ip net.IP) string {
+	i := sort.Search(len(r), func(i int) bool {
+		return bytes.Compare(r[i].start, ip) > 0
+	})
+	if i > 0 && bytes.Compare(r[i-1].end, ip) >= 0 {
+		return r[i-1].rir
+	}
+	return ""
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+// Without delegation files, the bundled IPv4 /8s, IPv6 /12 blocks and ASN
+// blocks give the RIR.
+func TestRIRFallback(t *testing.T) {
+
+	r, err := loadRIR(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		addr string
+		want string
+	}{
+		{"2400::1", "apnic"},
+		{"240f:ffff::1", "apnic"},
+		{"2600::1", "arin"},
+		{"2800::1", "lacnic"},
+		{"2a00::1", "ripencc"},
+		{"2a1f:ffff::1", "ripencc"},
+		{"2c00::1", "afrinic"},
+		{"2001:4860::8888", ""},
+		{"2003::1", ""},
+		{"2a20::1", ""},
+		{"8.8.8.8", "arin"},
+		{"1.1.1.1", "apnic"},
+		{"5.6.7.8", "ripencc"},
+		{"41.0.0.1", "afrinic"},
+		{"200.1.2.3", "lacnic"},
+		{"25.0.0.1", "ripencc"},
+		{"224.0.0.1", ""},
+	} {
+		got := r.lookupAddr(net.ParseIP(c.addr))
+		if got != c.want {
+			t.Errorf("%s: got %q, expected %q", c.addr, got, c.want)
+		}
+	}
+
+	for _, c := range []struct {
+		asn  uint
+		want string
+	}{
+		{15169, "arin"},
+		{3320, "ripencc"},
+		{4766, "apnic"},
+		{26599, "lacnic"},
+		{36924, "afrinic"},
+		{23456, ""},
+		{64500, ""},
+		{132203, "apnic"},
+		{202425, "ripencc"},
+		{396982, "arin"},
+	} {
+		got := r.lookupASN(c.asn)
+		if got != c.want {
+			t.Errorf("AS%d: got %q, expected %q", c.asn, got, c.want)
+		}
+	}
+
+}
+
+// Delegation files take precedence over the bundled blocks, and cover IPv4
+// and ASNs.
+func TestRIRFiles(t *testing.T) {
+
+	dir, cleanup := testDir(t)
+	defer cleanup()
+
+	path := filepath.Join(dir, "delegated-test")
+	err := ioutil.WriteFile(path, []byte(
+		"2|ripencc|20240101|4|19830705|20240101|+0000\n"+
+			"ripencc|*|ipv4|*|1|summary\n"+
+			"arin|US|ipv4|5.6.0.0|65536|20100101|allocated\n"+
+			"arin|US|ipv6|2a00:1000::|32|20100101|allocated\n"+
+			"lacnic|BR|asn|64500|10|20100101|assigned\n"+
+			"apnic|AU|asn|64510|1|20100101|available\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := loadRIR([]string{path})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		addr string
+		want string
+	}{
+		{"5.6.0.0", "arin"},
+		{"5.6.255.255", "arin"},
+		{"5.7.0.0", "ripencc"},
+		{"2a00:1000::1", "arin"},
+		{"2a00:1001::1", "ripencc"},
+	} {
+		got := r.lookupAddr(net.ParseIP(c.addr))
+		if got != c.want {
+			t.Errorf("%s: got %q, expected %q", c.addr, got, c.want)
+		}
+	}
+
+	for _, c := range []struct {
+		asn  uint
+		want string
+	}{
+		{64499, ""},
+		{64500, "lacnic"},
+		{64509, "lacnic"},
+		{64510, ""},
+	} {
+		got := r.lookupASN(c.asn)
+		if got != c.want {
+			t.Errorf("AS%d: got %q, expected %q", c.asn, got, c.want)
+		}
+	}
+
+}
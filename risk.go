@@ -0,0 +1,137 @@
+//
+// Composite risk score, 0 to 100, for triage.  Each signal present adds its
+// weight once, however many ends it's present at, and the total is capped
+// at 100:
+//
+//   tor           either end is a Tor exit node
+//   proxy         either end is a public proxy
+//   vpn           either end is an anonymous VPN
+//   anonymous     either end is anonymous in some other way
+//   hosting       either end is a hosting provider
+//   cross_border  the ends are in different countries
+//   distance      the ends are far apart, scaled by the distance over half
+//                 the Earth's circumference, so antipodes get the full weight
+//
+// GEOIP_RISK_WEIGHTS overrides weights, e.g. "tor=50,hosting=5".  The
+// anonymous-IP signals need that database; the others need both ends to have
+// a location.  With none of the signals available, there's no score.
+//
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Default signal weights.
+var defaultRiskWeights = map[string]float64{
+	"tor":          40,
+	"proxy":        30,
+	"vpn":          25,
+	"anonymous":    20,
+	"hosting":      15,
+	"cross_border": 10,
+	"distance":     10,
+}
+
+// Parse weight overrides onto the defaults.
+func parseRiskWeights(v string) (map[string]float64, error) {
+
+	weights := map[string]float64{}
+	for k, w := range defaultRiskWeights {
+		weights[k] = w
+	}
+
+	for _, ent := range strings.Split(v, ",") {
+
+		ent = strings.TrimSpace(ent)
+		if ent == "" {
+			continue
+		}
+
+		kv := strings.SplitN(ent, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("expected signal=weight: %s", ent)
+		}
+		if _, ok := defaultRiskWeights[kv[0]]; !ok {
+			return nil, fmt.Errorf("unknown signal: %s", kv[0])
+		}
+		w, err := strconv.ParseFloat(kv[1], 64)
+		if err != nil || w < 0 {
+			return nil, fmt.Errorf("bad weight: %s", ent)
+		}
+		weights[kv[0]] = w
+
+	}
+
+	return weights, nil
+
+}
+
+// Risk score for a location, before it's shaped, or nil if no signals are
+// available.  Call with the lock held.
+func (s *work) riskScore(l *locationInfo) *int {
+
+	available := false
+	score := 0.0
+
+	// Anonymous-IP flags, from either end.
+	if s.anonDB.loaded() {
+		available = true
+		var tor, proxy, vpn, anonymous, hosting bool
+		for _, p := range []*place{l.Src, l.Dest} {
+			if p == nil {
+				continue
+			}
+			tor = tor || p.IsTorExitNode
+			proxy = proxy || p.IsPublicProxy
+			vpn = vpn || p.IsAnonymousVPN
+			anonymous = anonymous || (p.IsAnonymous && !p.IsTorExitNode &&
+				!p.IsPublicProxy && !p.IsAnonymousVPN)
+			hosting = hosting || p.IsHostingProvider
+		}
+		for _, sig := range []struct {
+			name string
+			set  bool
+		}{
+			{"tor", tor},
+			{"proxy", proxy},
+			{"vpn", vpn},
+			{"anonymous", anonymous},
+			{"hosting", hosting},
+		} {
+			if sig.set {
+				score += s.riskWeights[sig.name]
+			}
+		}
+	}
+
+	// Relationship between the ends.
+	if l.Src != nil && l.Dest != nil {
+		if l.Src.IsoCode != "" && l.Dest.IsoCode != "" {
+			available = true
+			if l.Src.IsoCode != l.Dest.IsoCode {
+				score += s.riskWeights["cross_border"]
+			}
+		}
+		if l.Src.Position != nil && l.Dest.Position != nil {
+			available = true
+			d := haversine(l.Src.Position.Latitude,
+				l.Src.Position.Longitude, l.Dest.Position.Latitude,
+				l.Dest.Position.Longitude)
+			score += s.riskWeights["distance"] * d /
+				(math.Pi * earthRadiusKm)
+		}
+	}
+
+	if !available {
+		return nil
+	}
+
+	r := int(math.Min(100, math.Floor(score+0.5)))
+	return &r
+
+}
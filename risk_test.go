@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// A signal present at both ends counts once, and the distance is scored
+// even when GeoJSON output replaces the positions.
+func TestRiskScoreSignalsOnce(t *testing.T) {
+
+	dir, cleanup := testDir(t)
+	defer cleanup()
+
+	at := func(iso string, lat, lon float64) map[string]interface{} {
+		rec := testCityRecord(iso, iso, "")
+		rec["location"] = map[string]interface{}{
+			"latitude":  lat,
+			"longitude": lon,
+		}
+		return rec
+	}
+	tor := map[string]interface{}{
+		"is_anonymous":     true,
+		"is_tor_exit_node": true,
+	}
+
+	s, closeDBs := testWork(t, map[string]string{
+		"GEOIP_DB": testDB(t, dir, "city.mmdb", "GeoLite2-City", 1,
+			[]testNetwork{
+				{"1.2.3.0/24", at("GB", 0, 0)},
+				{"5.6.7.0/24", at("NZ", 0, 180)},
+			}),
+		"GEOIP_ASN_DB": testDB(t, dir, "asn.mmdb", "GeoLite2-ASN", 1,
+			nil),
+		"GEOIP_ANON_DB": testDB(t, dir, "anon.mmdb", "GeoIP2-Anonymous-IP",
+			1, []testNetwork{{"1.2.3.0/24", tor}, {"5.6.7.0/24", tor}}),
+		"GEOIP_RISK_SCORE":   "true",
+		"GEOIP_RISK_WEIGHTS": "tor=40,cross_border=0,distance=10",
+		"GEOIP_GEOJSON":      "replace",
+	})
+	defer closeDBs()
+
+	var ev struct {
+		Location struct {
+			RiskScore *int `json:"risk_score"`
+		} `json:"location"`
+	}
+	out := testHandle(t, s,
+		`{"id":"1","src":["ipv4:1.2.3.4"],"dest":["ipv4:5.6.7.8"]}`)
+	err := json.Unmarshal(out, &ev)
+	if err != nil {
+		t.Fatalf("bad output %q: %s", out, err.Error())
+	}
+
+	// Tor once, and the full distance weight for antipodes.
+	if ev.Location.RiskScore == nil || *ev.Location.RiskScore != 50 {
+		t.Errorf("risk score: got %s, expected 50", out)
+	}
+
+}
+
+// In merge mode, the score is kept alongside an upstream location.
+func TestRiskScoreMerged(t *testing.T) {
+
+	dir, cleanup := testDir(t)
+	defer cleanup()
+
+	env := testDBEnv(t, dir)
+	env["GEOIP_RISK_SCORE"] = "true"
+	env["GEOIP_MERGE_LOCATION"] = "true"
+	s, closeDBs := testWork(t, env)
+	defer closeDBs()
+
+	var ev struct {
+		Location struct {
+			Src struct {
+				City string `json:"city"`
+			} `json:"src"`
+			RiskScore *int `json:"risk_score"`
+		} `json:"location"`
+	}
+	out := testHandle(t, s, `{"id":"1","src":["ipv4:1.2.3.4"],`+
+		`"dest":["ipv6:2001:4860::1"],"location":{"src":{"city":"Leeds"}}}`)
+	err := json.Unmarshal(out, &ev)
+	if err != nil {
+		t.Fatalf("bad output %q: %s", out, err.Error())
+	}
+
+	// Upstream fields kept, and cross-border scored.
+	if ev.Location.Src.City != "Leeds" {
+		t.Errorf("upstream city replaced: %s", out)
+	}
+	if ev.Location.RiskScore == nil || *ev.Location.RiskScore != 10 {
+		t.Errorf("risk score: got %s, expected 10", out)
+	}
+
+}
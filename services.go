@@ -0,0 +1,100 @@
+//
+// Well-known service names for destination ports, with GEOIP_DEST_SERVICE.
+// Ports come from "tcp:N" and "udp:N" entries in the destination address
+// list; the first one found is used.  Names are the IANA service names.
+//
+
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Service names by "protocol/port".
+var wellKnownServices = map[string]string{
+	"tcp/20":    "ftp-data",
+	"tcp/21":    "ftp",
+	"tcp/22":    "ssh",
+	"tcp/23":    "telnet",
+	"tcp/25":    "smtp",
+	"tcp/43":    "whois",
+	"tcp/53":    "domain",
+	"udp/53":    "domain",
+	"udp/67":    "bootps",
+	"udp/68":    "bootpc",
+	"udp/69":    "tftp",
+	"tcp/80":    "http",
+	"udp/80":    "http",
+	"tcp/88":    "kerberos",
+	"udp/88":    "kerberos",
+	"tcp/110":   "pop3",
+	"udp/123":   "ntp",
+	"tcp/135":   "epmap",
+	"udp/137":   "netbios-ns",
+	"udp/138":   "netbios-dgm",
+	"tcp/139":   "netbios-ssn",
+	"tcp/143":   "imap",
+	"udp/161":   "snmp",
+	"udp/162":   "snmptrap",
+	"tcp/179":   "bgp",
+	"tcp/389":   "ldap",
+	"udp/389":   "ldap",
+	"tcp/443":   "https",
+	"udp/443":   "https",
+	"tcp/445":   "microsoft-ds",
+	"tcp/465":   "submissions",
+	"udp/500":   "isakmp",
+	"udp/514":   "syslog",
+	"tcp/587":   "submission",
+	"tcp/636":   "ldaps",
+	"tcp/853":   "domain-s",
+	"udp/853":   "domain-s",
+	"tcp/873":   "rsync",
+	"tcp/993":   "imaps",
+	"tcp/995":   "pop3s",
+	"udp/1194":  "openvpn",
+	"tcp/1433":  "ms-sql-s",
+	"udp/1812":  "radius",
+	"udp/1813":  "radius-acct",
+	"tcp/1883":  "mqtt",
+	"tcp/2049":  "nfs",
+	"udp/2049":  "nfs",
+	"tcp/3306":  "mysql",
+	"tcp/3389":  "ms-wbt-server",
+	"udp/3478":  "stun",
+	"udp/4500":  "ipsec-nat-t",
+	"tcp/5060":  "sip",
+	"udp/5060":  "sip",
+	"tcp/5061":  "sips",
+	"tcp/5432":  "postgresql",
+	"tcp/5671":  "amqps",
+	"tcp/5672":  "amqp",
+	"tcp/5900":  "rfb",
+	"tcp/6379":  "redis",
+	"tcp/8080":  "http-alt",
+	"tcp/8883":  "secure-mqtt",
+	"tcp/11211": "memcache",
+	"udp/11211": "memcache",
+	"tcp/27017": "mongodb",
+}
+
+// Service name for the first port in an address list, or empty if there's
+// no port or it isn't well known.
+func destService(addrs []string) string {
+
+	for _, v := range scannedAddrs(addrs) {
+		kv := strings.SplitN(v, ":", 2)
+		if len(kv) != 2 || (kv[0] != "tcp" && kv[0] != "udp") {
+			continue
+		}
+		port, err := strconv.ParseUint(kv[1], 10, 16)
+		if err != nil {
+			continue
+		}
+		return wellKnownServices[kv[0]+"/"+strconv.FormatUint(port, 10)]
+	}
+
+	return ""
+
+}
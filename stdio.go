@@ -0,0 +1,137 @@
+//
+// Local input/output, for debugging, for use as a filter in a shell
+// pipeline, and for replaying captured events.  Events are newline-delimited
+// JSON.
+//
+// An output of "-" writes enriched events to stdout instead of the output
+// queues.  An input of "-" reads events from stdin, and always writes to
+// stdout.  -replay reads events from a file and writes them to stdout, or
+// the file given by -replay-output.  Without queues, all outputs, including
+// any dead-letter output, are the one local stream, and a failed event is
+// retried straight away, up to GEOIP_MAX_ATTEMPTS, as there's no queue to
+// redeliver it.  Input lines over
+// GEOIP_MAX_MESSAGE_SIZE, or 16MB, are skipped and counted as oversize
+// messages; with GEOIP_OVERSIZE_ACTION=forward, lines up to 16MB are
+// forwarded.
+//
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"time"
+
+	"github.com/trustnetworks/analytics-common/worker"
+	"golang.org/x/net/context"
+)
+
+// Largest line read when there's no message size limit.
+const maxLocalLine = 16 * 1024 * 1024
+
+// Send an event to the named output, or the local output if there is one.
+// w is unused, and may be nil, with a local output.
+func (s *work) send(w *worker.Worker, output string, msg []byte) {
+
+	if s.localOut == nil {
+		start := time.Now()
+		w.Send(output, msg)
+		if s.backpressure != nil {
+			s.backpressure.observe(time.Since(start))
+		}
+		return
+	}
+
+	s.localLock.Lock()
+	defer s.localLock.Unlock()
+	s.localOut.Write(msg)
+	s.localOut.Write([]byte("\n"))
+
+}
+
+// Run events from a reader through the handler until end of input or
+// cancellation.
+func (s *work) runLocal(ctx context.Context, r io.Reader) error {
+
+	// Lines over the limit are discarded as they are read, so one can't
+	// end the run or use unbounded memory.  Oversize messages which are
+	// forwarded are read whole, up to the local line limit.
+	max := maxLocalLine
+	if s.maxMessageSize > 0 && !s.forwardOversize {
+		max = s.maxMessageSize
+	}
+
+	br := bufio.NewReaderSize(r, 64*1024)
+
+	for {
+
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		line, over, err := readLine(br, max)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if over {
+			oversizeMessages.Add(1)
+			s.errLog.log("Dropping input lines over %d bytes", max)
+			continue
+		}
+
+		if len(line) == 0 {
+			continue
+		}
+
+		// Handle gives back a failed event to redeliver until it's
+		// dead-lettered.
+		for attempt := 1; ; attempt++ {
+			err := s.Handle(line, nil)
+			if err == nil || attempt >= s.maxAttempts {
+				break
+			}
+		}
+
+	}
+
+}
+
+// Read a line, without its line ending.  A line over max bytes is read to
+// its end and discarded, returning true.  Returns io.EOF at the end of
+// input.
+func readLine(r *bufio.Reader, max int) ([]byte, bool, error) {
+
+	var line []byte
+	over := false
+
+	for {
+
+		// The reader's buffer is reused, so the line is a copy.
+		chunk, err := r.ReadSlice('\n')
+		if !over {
+			line = append(line, chunk...)
+			if len(bytes.TrimRight(line, "\r\n")) > max {
+				line = nil
+				over = true
+			}
+		}
+
+		switch {
+		case err == bufio.ErrBufferFull:
+			continue
+		case err == io.EOF && len(line) == 0 && !over:
+			return nil, false, io.EOF
+		case err != nil && err != io.EOF:
+			return nil, false, err
+		}
+
+		return bytes.TrimRight(line, "\r\n"), over, nil
+
+	}
+
+}
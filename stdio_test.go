@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+// Over-long lines are skipped and counted, and don't stop the lines after
+// them being read.
+func TestReadLine(t *testing.T) {
+
+	input := "short\r\n" + strings.Repeat("x", 100) + "\n" +
+		"exactly10!\n\n" + strings.Repeat("y", 11) + "\nlast"
+	r := bufio.NewReaderSize(strings.NewReader(input), 16)
+
+	for _, want := range []struct {
+		line string
+		over bool
+	}{
+		{"short", false},
+		{"", true},
+		{"exactly10!", false},
+		{"", false},
+		{"", true},
+		{"last", false},
+	} {
+		line, over, err := readLine(r, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(line) != want.line || over != want.over {
+			t.Errorf("got %q, %v, expected %q, %v", line, over, want.line,
+				want.over)
+		}
+	}
+
+	_, _, err := readLine(r, 10)
+	if err != io.EOF {
+		t.Errorf("got %v at end of input, expected EOF", err)
+	}
+
+}
+
+// An oversize event on stdin is dropped and counted, and the run goes on.
+func TestRunLocalOversize(t *testing.T) {
+
+	dir, cleanup := testDir(t)
+	defer cleanup()
+
+	env := testDBEnv(t, dir)
+	env["GEOIP_MAX_MESSAGE_SIZE"] = "200"
+	s, closeDBs := testWork(t, env)
+	defer closeDBs()
+
+	big := `{"id":"big","src":["ipv4:1.2.3.4"],"pad":"` +
+		strings.Repeat("x", 100000) + `"}`
+	input := `{"id":"1","src":["ipv4:1.2.3.4"]}` + "\n" + big + "\n" +
+		`{"id":"2","src":["ipv4:1.2.3.4"]}` + "\n"
+
+	var out bytes.Buffer
+	s.localOut = &out
+	before := oversizeMessages.Value()
+	err := s.runLocal(context.Background(), strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := oversizeMessages.Value() - before; n != 1 {
+		t.Errorf("%d oversize messages counted, expected 1", n)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[0], `"id":"1"`) ||
+		!strings.Contains(lines[1], `"id":"2"`) {
+		t.Errorf("output: %s", out.String())
+	}
+
+}
+
+// A formatter which always fails.
+type failingFormatter struct{}
+
+func (failingFormatter) format(ev *event, body []byte) ([]byte, error) {
+	return nil, errors.New("broken")
+}
+
+// Without a queue, a failing event is retried up to the attempt limit, then
+// dead-lettered to the local stream.
+func TestRunLocalDeadLetter(t *testing.T) {
+
+	dir, cleanup := testDir(t)
+	defer cleanup()
+
+	env := testDBEnv(t, dir)
+	env["GEOIP_DEAD_LETTER_OUTPUT"] = "dead"
+	env["GEOIP_MAX_ATTEMPTS"] = "3"
+	s, closeDBs := testWork(t, env)
+	defer closeDBs()
+	s.formatter = failingFormatter{}
+
+	var out bytes.Buffer
+	s.localOut = &out
+	err := s.runLocal(context.Background(),
+		strings.NewReader(`{"id":"1","src":["ipv4:1.2.3.4"]}`+"\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var dl deadLetter
+	err = json.Unmarshal(bytes.TrimSpace(out.Bytes()), &dl)
+	if err != nil {
+		t.Fatalf("output %q: %s", out.String(), err.Error())
+	}
+	if dl.Attempts != 3 || !strings.Contains(dl.Error, "broken") {
+		t.Errorf("dead letter %+v", dl)
+	}
+
+}
@@ -0,0 +1,222 @@
+//
+// Aggregated summaries.  With GEOIP_SUMMARY_OUTPUT set, source and
+// destination countries and ASNs are counted over tumbling windows of
+// GEOIP_SUMMARY_WINDOW (default 1m), and a summary of the top
+// GEOIP_SUMMARY_TOP_K (default 10) of each is sent to that output when a
+// window closes.  Windows are closed on a timer, so a summary goes out within
+// a second of the window's end even when events stop, through the queue
+// worker of the last event counted.
+//
+// Counting is memory-bounded: each table keeps a fixed number of keys, using
+// the space-saving algorithm, so the top counts are approximate once more
+// keys than that have been seen.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/trustnetworks/analytics-common/worker"
+)
+
+// Keys kept per table, for each of the top K reported.
+const summaryKeysPerTopK = 10
+
+// Longest a closed window waits for its summary to be sent.
+const summaryTick = time.Second
+
+// Bounded counts, by the space-saving algorithm: when the table is full, a
+// new key replaces the smallest count, and takes over that count.
+type topCounter struct {
+	capacity int
+	counts   map[string]int64
+}
+
+func newTopCounter(capacity int) *topCounter {
+	return &topCounter{capacity: capacity, counts: map[string]int64{}}
+}
+
+func (c *topCounter) add(key string) {
+
+	if _, ok := c.counts[key]; ok || len(c.counts) < c.capacity {
+		c.counts[key]++
+		return
+	}
+
+	var minKey string
+	var min int64 = -1
+	for k, v := range c.counts {
+		if min < 0 || v < min {
+			minKey, min = k, v
+		}
+	}
+	delete(c.counts, minKey)
+	c.counts[key] = min + 1
+
+}
+
+// A key and its count in a summary.
+type summaryCount struct {
+	Key   string `json:"key"`
+	Count int64  `json:"count"`
+}
+
+// The k highest counts, highest first.
+func (c *topCounter) top(k int) []summaryCount {
+	top := make([]summaryCount, 0, len(c.counts))
+	for key, n := range c.counts {
+		top = append(top, summaryCount{key, n})
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Count != top[j].Count {
+			return top[i].Count > top[j].Count
+		}
+		return top[i].Key < top[j].Key
+	})
+	if len(top) > k {
+		top = top[:k]
+	}
+	return top
+}
+
+// Summary record.
+type summaryRecord struct {
+	Summary     string         `json:"summary"`
+	WindowStart string         `json:"window_start"`
+	WindowEnd   string         `json:"window_end"`
+	Events      int64          `json:"events"`
+	Countries   []summaryCount `json:"countries"`
+	ASNs        []summaryCount `json:"asns"`
+}
+
+// Counts for the current window.
+type summary struct {
+	output string
+	window time.Duration
+	topK   int
+
+	lock      sync.Mutex
+	worker    *worker.Worker
+	start     time.Time
+	events    int64
+	countries *topCounter
+	asns      *topCounter
+}
+
+func newSummary(output string, window time.Duration, topK int) *summary {
+	s := &summary{output: output, window: window, topK: topK}
+	s.reset(time.Now())
+	return s
+}
+
+func (s *summary) reset(start time.Time) {
+	s.start = start
+	s.events = 0
+	s.countries = newTopCounter(s.topK * summaryKeysPerTopK)
+	s.asns = newTopCounter(s.topK * summaryKeysPerTopK)
+}
+
+// Count an event's location, first sending the summary of the last window
+// if it has closed.
+func (s *work) summarise(w *worker.Worker, loc *locationInfo) {
+
+	sm := s.summary
+	sm.lock.Lock()
+
+	last, j := s.closeWindow(time.Now())
+	sm.worker = w
+	sm.events++
+	if loc != nil {
+		for _, p := range []*place{loc.Src, loc.Dest} {
+			if p == nil {
+				continue
+			}
+			if p.IsoCode != "" {
+				sm.countries.add(p.IsoCode)
+			}
+			if p.ASNum != 0 {
+				sm.asns.add(strconv.FormatUint(uint64(p.ASNum), 10))
+			}
+		}
+	}
+
+	// Sent without the lock, so a slow output doesn't hold up counting.
+	sm.lock.Unlock()
+	if j != nil {
+		s.send(last, sm.output, j)
+	}
+
+}
+
+// Goroutine: send summaries of windows which have closed without another
+// event.
+func (s *work) summaryFlusher() {
+
+	interval := summaryTick
+	if s.summary.window < interval {
+		interval = s.summary.window
+	}
+
+	for range time.Tick(interval) {
+		sm := s.summary
+		sm.lock.Lock()
+		w, j := s.closeWindow(time.Now())
+		sm.lock.Unlock()
+		if j != nil {
+			s.send(w, sm.output, j)
+		}
+	}
+
+}
+
+// If the current window has closed, start the next, returning the summary
+// to send, if it had events, and the worker to send it with.  Call with the
+// summary lock held.
+func (s *work) closeWindow(now time.Time) (*worker.Worker, []byte) {
+
+	sm := s.summary
+	if now.Sub(sm.start) < sm.window {
+		return nil, nil
+	}
+
+	var j []byte
+	if sm.events > 0 {
+		j = s.summaryJSON()
+	}
+
+	// Windows are aligned to the first one, with empty ones skipped.
+	n := now.Sub(sm.start) / sm.window
+	sm.reset(sm.start.Add(n * sm.window))
+
+	return sm.worker, j
+
+}
+
+// Summary of the current window, with the summary lock held, or nil if it
+// can't be encoded.
+func (s *work) summaryJSON() []byte {
+
+	sm := s.summary
+	end := sm.start.Add(sm.window)
+	rec := summaryRecord{
+		Summary:     "geoip",
+		WindowStart: sm.start.UTC().Format(time.RFC3339),
+		WindowEnd:   end.UTC().Format(time.RFC3339),
+		Events:      sm.events,
+		Countries:   sm.countries.top(sm.topK),
+		ASNs:        sm.asns.top(sm.topK),
+	}
+
+	j, err := json.Marshal(&rec)
+	if err != nil {
+		s.errLog.log("Summary marshal error: %s", err.Error())
+		return nil
+	}
+	return j
+
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Output which is safe to read while the flusher writes.
+type lockedBuffer struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.String()
+}
+
+// A window is summarised once it closes, without waiting for another event.
+func TestSummaryFlushedWithoutEvents(t *testing.T) {
+
+	var out lockedBuffer
+	s := &work{
+		summary:  newSummary("summary", 50*time.Millisecond, 3),
+		localOut: &out,
+	}
+	src, dest := &place{}, &place{}
+	src.IsoCode, src.ASNum = "GB", 64500
+	dest.IsoCode = "US"
+	s.summarise(nil, &locationInfo{Src: src, Dest: dest})
+	go s.summaryFlusher()
+
+	var rec summaryRecord
+	deadline := time.Now().Add(2 * time.Second)
+	for out.String() == "" && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	err := json.Unmarshal(bytes.TrimSpace([]byte(out.String())), &rec)
+	if err != nil {
+		t.Fatalf("summary %q: %s", out.String(), err.Error())
+	}
+	if rec.Events != 1 || len(rec.Countries) != 2 || len(rec.ASNs) != 1 {
+		t.Errorf("got %+v", rec)
+	}
+
+	// An empty window sends nothing.
+	s.summary.lock.Lock()
+	_, j := s.closeWindow(time.Now().Add(time.Minute))
+	s.summary.lock.Unlock()
+	if j != nil {
+		t.Errorf("empty window summarised: %s", j)
+	}
+
+}
@@ -0,0 +1,349 @@
+//
+// MaxMind DB files for tests, written from a list of networks and their
+// records, so that tests don't depend on downloaded databases.  Only what
+// the tests need is supported: an IPv6 tree with 32-bit records, IPv4
+// networks in its IPv4-compatible part, and the data types the GeoIP2
+// editions use.
+//
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// A network and its record.
+type testNetwork struct {
+	cidr   string
+	record map[string]interface{}
+}
+
+// A search tree node.  Each record is 0 for no data, a node index, or
+// -(i+1) for the i'th data record.
+type testNode struct {
+	rec [2]int
+}
+
+// Write a MaxMind DB file with the given database type, build epoch and
+// networks.
+func writeTestDB(path, dbType string, epoch uint64,
+	nets []testNetwork) error {
+
+	nodes := []testNode{{}}
+	for i, n := range nets {
+
+		_, ipnet, err := net.ParseCIDR(n.cidr)
+		if err != nil {
+			return err
+		}
+		ones, _ := ipnet.Mask.Size()
+		ip := ipnet.IP.To16()
+		if len(ipnet.Mask) == net.IPv4len {
+			ip = append(make(net.IP, 12), ipnet.IP.To4()...)
+			ones += 96
+		}
+
+		bit := func(i int) int {
+			return int(ip[i/8]>>uint(7-i%8)) & 1
+		}
+
+		// Walk down to the network's node, adding nodes, and splitting a
+		// larger network's record over two when passing through it.
+		cur := 0
+		for b := 0; b < ones-1; b++ {
+			next := nodes[cur].rec[bit(b)]
+			if next <= 0 {
+				nodes = append(nodes, testNode{rec: [2]int{next, next}})
+				next = len(nodes) - 1
+				nodes[cur].rec[bit(b)] = next
+			}
+			cur = next
+		}
+		nodes[cur].rec[bit(ones-1)] = -(i + 1)
+
+	}
+
+	// Data section, and each record's offset in it.
+	var data bytes.Buffer
+	offsets := make([]int, len(nets))
+	for i, n := range nets {
+		offsets[i] = data.Len()
+		encodeTestValue(&data, n.record)
+	}
+
+	var buf bytes.Buffer
+	count := len(nodes)
+	for _, n := range nodes {
+		for _, r := range n.rec {
+			v := uint32(count)
+			switch {
+			case r > 0:
+				v = uint32(r)
+			case r < 0:
+				v = uint32(count + 16 + offsets[-r-1])
+			}
+			binary.Write(&buf, binary.BigEndian, v)
+		}
+	}
+	buf.Write(make([]byte, 16))
+	buf.Write(data.Bytes())
+
+	buf.WriteString("\xab\xcd\xefMaxMind.com")
+	encodeTestValue(&buf, map[string]interface{}{
+		"binary_format_major_version": uint16(2),
+		"binary_format_minor_version": uint16(0),
+		"build_epoch":                 epoch,
+		"database_type":               dbType,
+		"description": map[string]interface{}{
+			"en": "Test " + dbType,
+		},
+		"ip_version":  uint16(6),
+		"languages":   []interface{}{"en"},
+		"node_count":  uint32(count),
+		"record_size": uint16(32),
+	})
+
+	return ioutil.WriteFile(path, buf.Bytes(), 0644)
+
+}
+
+// Write a control byte for a data type and payload size.  Types over 7 are
+// extended types.
+func encodeTestControl(buf *bytes.Buffer, typ, size int) {
+
+	ctrl := byte(typ << 5)
+	if typ > 7 {
+		ctrl = 0
+	}
+
+	var ext []byte
+	switch {
+	case size < 29:
+		ctrl |= byte(size)
+	case size < 285:
+		ctrl |= 29
+		ext = []byte{byte(size - 29)}
+	case size < 65821:
+		ctrl |= 30
+		size -= 285
+		ext = []byte{byte(size >> 8), byte(size)}
+	default:
+		ctrl |= 31
+		size -= 65821
+		ext = []byte{byte(size >> 16), byte(size >> 8), byte(size)}
+	}
+
+	buf.WriteByte(ctrl)
+	if typ > 7 {
+		buf.WriteByte(byte(typ - 7))
+	}
+	buf.Write(ext)
+
+}
+
+// Write an unsigned integer of a data type, in as few bytes as it needs.
+func encodeTestUint(buf *bytes.Buffer, typ int, v uint64) {
+	var b []byte
+	for ; v > 0; v >>= 8 {
+		b = append([]byte{byte(v)}, b...)
+	}
+	encodeTestControl(buf, typ, len(b))
+	buf.Write(b)
+}
+
+// Write a value.  Strings, float64s, bools, maps and slices are written as
+// their MaxMind DB types; ints and uints as uint32s.
+func encodeTestValue(buf *bytes.Buffer, v interface{}) {
+
+	switch v := v.(type) {
+
+	case string:
+		encodeTestControl(buf, 2, len(v))
+		buf.WriteString(v)
+
+	case float64:
+		encodeTestControl(buf, 3, 8)
+		binary.Write(buf, binary.BigEndian, math.Float64bits(v))
+
+	case uint16:
+		encodeTestUint(buf, 5, uint64(v))
+
+	case uint32:
+		encodeTestUint(buf, 6, uint64(v))
+
+	case int:
+		encodeTestUint(buf, 6, uint64(v))
+
+	case uint:
+		encodeTestUint(buf, 6, uint64(v))
+
+	case uint64:
+		encodeTestUint(buf, 9, v)
+
+	case bool:
+		size := 0
+		if v {
+			size = 1
+		}
+		encodeTestControl(buf, 14, size)
+
+	case map[string]string:
+		m := map[string]interface{}{}
+		for k, s := range v {
+			m[k] = s
+		}
+		encodeTestValue(buf, m)
+
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		encodeTestControl(buf, 7, len(v))
+		for _, k := range keys {
+			encodeTestValue(buf, k)
+			encodeTestValue(buf, v[k])
+		}
+
+	case []interface{}:
+		encodeTestControl(buf, 11, len(v))
+		for _, e := range v {
+			encodeTestValue(buf, e)
+		}
+
+	default:
+		panic(fmt.Sprintf("can't encode %T", v))
+
+	}
+
+}
+
+// A City record with a country, and optionally a city.
+func testCityRecord(iso, country, city string) map[string]interface{} {
+	rec := map[string]interface{}{
+		"country": map[string]interface{}{
+			"iso_code": iso,
+			"names":    map[string]string{"en": country},
+		},
+	}
+	if city != "" {
+		rec["city"] = map[string]interface{}{
+			"names": map[string]string{"en": city},
+		}
+	}
+	return rec
+}
+
+// An ASN record.
+func testASNRecord(asn uint, org string) map[string]interface{} {
+	return map[string]interface{}{
+		"autonomous_system_number":       asn,
+		"autonomous_system_organization": org,
+	}
+}
+
+// A temporary directory for test databases, and a function to remove it.
+func testDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "geoip-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+// Write a test database into a directory, returning its path.
+func testDB(t *testing.T, dir, name, dbType string, epoch uint64,
+	nets []testNetwork) string {
+	path := filepath.Join(dir, name)
+	err := writeTestDB(path, dbType, epoch, nets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// Set environment variables for a test, returning a function which puts
+// back the previous values.
+func setTestEnv(env map[string]string) func() {
+	old := map[string]*string{}
+	for k, v := range env {
+		if prev, ok := os.LookupEnv(k); ok {
+			old[k] = &prev
+		} else {
+			old[k] = nil
+		}
+		os.Setenv(k, v)
+	}
+	return func() {
+		for k, v := range old {
+			if v == nil {
+				os.Unsetenv(k)
+			} else {
+				os.Setenv(k, *v)
+			}
+		}
+	}
+}
+
+// A worker initialised from the environment given, over the defaults, with
+// its databases open, and a function to close them.
+func testWork(t *testing.T, env map[string]string) (*work, func()) {
+
+	defer setTestEnv(env)()
+
+	s := &work{}
+	err := s.init(make(chan bool, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s, func() {
+		for _, d := range append(s.requiredDBs(), s.optionalDBs()...) {
+			d.close()
+		}
+	}
+
+}
+
+// Environment for a worker with small City and ASN databases in a
+// directory, covering 1.2.3.0/24 and 2001:4860::/32.
+func testDBEnv(t *testing.T, dir string) map[string]string {
+	return map[string]string{
+		"GEOIP_DB": testDB(t, dir, "city.mmdb", "GeoLite2-City", 1,
+			[]testNetwork{
+				{"1.2.3.0/24",
+					testCityRecord("GB", "United Kingdom", "London")},
+				{"2001:4860::/32",
+					testCityRecord("US", "United States", "")},
+			}),
+		"GEOIP_ASN_DB": testDB(t, dir, "asn.mmdb", "GeoLite2-ASN", 1,
+			[]testNetwork{
+				{"1.2.3.0/24", testASNRecord(64500, "Example Net")},
+				{"2001:4860::/32", testASNRecord(15169, "Google LLC")},
+			}),
+	}
+}
+
+// Handle an event, returning what was sent, without the trailing newline.
+func testHandle(t *testing.T, s *work, msg string) []byte {
+
+	var out bytes.Buffer
+	s.localOut = &out
+	err := s.Handle([]byte(msg), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return bytes.TrimSuffix(out.Bytes(), []byte("\n"))
+
+}
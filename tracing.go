@@ -0,0 +1,286 @@
+//
+// OpenTelemetry spans for enrichment.  With GEOIP_OTLP_ENDPOINT set, e.g.
+// http://collector:4318/v1/traces, an event carrying a sampled W3C trace
+// context in its "traceparent" field gets a child span, "geoip.enrich",
+// covering the lookups, with the location as attributes:
+//
+//   geo.src.country, geo.dest.country   ISO country code
+//   geo.src.asn, geo.dest.asn           ASN
+//   geo.src.source, geo.dest.source     "database", "cache" or "flow cache"
+//   geo.lookup.latency_ms               lookup time
+//
+// Spans are sent in batches, as OTLP/HTTP JSON, every GEOIP_OTLP_INTERVAL
+// (default 5s).  The service name is GEOIP_OTLP_SERVICE, default "geoip".
+// Spans are dropped, and counted, if the exporter falls behind.  Without an
+// endpoint, nothing is traced.
+//
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	exportedSpans = expvar.NewInt("geoip_spans_exported")
+	droppedSpans  = expvar.NewInt("geoip_spans_dropped")
+)
+
+// Most spans sent in one export request, and queued for export.
+const (
+	maxSpanBatch = 512
+	maxSpanQueue = 4096
+)
+
+// OTLP span kind for an internal operation.
+const spanKindInternal = 1
+
+type tracer struct {
+	endpoint string
+	service  string
+	interval time.Duration
+	client   *http.Client
+	errLog   *rateLog
+	spans    chan *otlpSpan
+}
+
+// OTLP JSON encoding.  IDs are hex, and 64-bit integers are strings.
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name    string `json:"name"`
+		Version string `json:"version,omitempty"`
+	} `json:"scope"`
+	Spans []*otlpSpan `json:"spans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpExport struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+func stringAttr(key, v string) otlpAttribute {
+	return otlpAttribute{Key: key, Value: otlpValue{StringValue: &v}}
+}
+
+func intAttr(key string, v uint64) otlpAttribute {
+	s := strconv.FormatUint(v, 10)
+	return otlpAttribute{Key: key, Value: otlpValue{IntValue: &s}}
+}
+
+func doubleAttr(key string, v float64) otlpAttribute {
+	return otlpAttribute{Key: key, Value: otlpValue{DoubleValue: &v}}
+}
+
+// Create a tracer, and start its exporter goroutine.
+func newTracer(endpoint, service string, interval time.Duration,
+	errLog *rateLog) *tracer {
+	t := &tracer{
+		endpoint: endpoint,
+		service:  service,
+		interval: interval,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		errLog:   errLog,
+		spans:    make(chan *otlpSpan, maxSpanQueue),
+	}
+	go t.exporter()
+	return t
+}
+
+// Trace and parent span IDs from a W3C traceparent, and whether it is
+// sampled.  Empty IDs if it isn't valid.
+func parseTraceParent(tp string) (string, string, bool) {
+
+	// version-traceid-parentid-flags, in lower-case hex.  Versions after
+	// 00 may add fields.
+	f := strings.Split(tp, "-")
+	if len(f) < 4 || len(f[0]) != 2 || f[0] == "ff" ||
+		(f[0] == "00" && len(f) != 4) {
+		return "", "", false
+	}
+
+	var fields [4][]byte
+	for i, size := range []int{1, 16, 8, 1} {
+		b, err := hex.DecodeString(f[i])
+		if err != nil || len(b) != size || f[i] != strings.ToLower(f[i]) {
+			return "", "", false
+		}
+		fields[i] = b
+	}
+
+	// All-zero IDs are invalid.
+	for _, id := range fields[1:3] {
+		if bytes.Equal(id, make([]byte, len(id))) {
+			return "", "", false
+		}
+	}
+
+	return f[1], f[2], fields[3][0]&1 == 1
+
+}
+
+// Record the enrichment span for an event, if it has a sampled trace
+// context.
+func (t *tracer) enriched(traceParent string, start, end time.Time,
+	loc *locationInfo, sources lookupSources) {
+
+	traceID, parentID, sampled := parseTraceParent(traceParent)
+	if !sampled {
+		return
+	}
+
+	id := make([]byte, 8)
+	_, err := rand.Read(id)
+	if err != nil {
+		return
+	}
+
+	span := &otlpSpan{
+		TraceID:           traceID,
+		SpanID:            hex.EncodeToString(id),
+		ParentSpanID:      parentID,
+		Name:              "geoip.enrich",
+		Kind:              spanKindInternal,
+		StartTimeUnixNano: strconv.FormatInt(start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(end.UnixNano(), 10),
+	}
+
+	var src, dest *place
+	if loc != nil {
+		src, dest = loc.Src, loc.Dest
+	}
+	for _, d := range []struct {
+		dir    string
+		p      *place
+		source string
+	}{{"src", src, sources.Src}, {"dest", dest, sources.Dest}} {
+		if d.p != nil && d.p.IsoCode != "" {
+			span.Attributes = append(span.Attributes,
+				stringAttr("geo."+d.dir+".country", d.p.IsoCode))
+		}
+		if d.p != nil && d.p.ASNum != 0 {
+			span.Attributes = append(span.Attributes,
+				intAttr("geo."+d.dir+".asn", uint64(d.p.ASNum)))
+		}
+		if d.source != "" {
+			span.Attributes = append(span.Attributes,
+				stringAttr("geo."+d.dir+".source", d.source))
+		}
+	}
+	span.Attributes = append(span.Attributes,
+		doubleAttr("geo.lookup.latency_ms",
+			float64(end.Sub(start))/float64(time.Millisecond)))
+
+	// Don't hold up events if the exporter is behind.
+	select {
+	case t.spans <- span:
+	default:
+		droppedSpans.Add(1)
+	}
+
+}
+
+// Goroutine: send queued spans every interval, or sooner once a batch is
+// full.
+func (t *tracer) exporter() {
+
+	tick := time.NewTicker(t.interval)
+	defer tick.Stop()
+
+	var batch []*otlpSpan
+	for {
+
+		select {
+		case span := <-t.spans:
+			batch = append(batch, span)
+			if len(batch) < maxSpanBatch {
+				continue
+			}
+		case <-tick.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+
+		err := t.export(batch)
+		if err != nil {
+			droppedSpans.Add(int64(len(batch)))
+			t.errLog.log("Span export error: %s", err.Error())
+		} else {
+			exportedSpans.Add(int64(len(batch)))
+		}
+		batch = nil
+
+	}
+
+}
+
+// Send a batch of spans to the collector.
+func (t *tracer) export(spans []*otlpSpan) error {
+
+	rs := otlpResourceSpans{}
+	rs.Resource.Attributes = []otlpAttribute{
+		stringAttr("service.name", t.service),
+		stringAttr("service.version", version),
+	}
+	ss := otlpScopeSpans{Spans: spans}
+	ss.Scope.Name = "geoip"
+	ss.Scope.Version = version
+	rs.ScopeSpans = []otlpScopeSpans{ss}
+
+	j, err := json.Marshal(&otlpExport{
+		ResourceSpans: []otlpResourceSpans{rs},
+	})
+	if err != nil {
+		return err
+	}
+
+	resp, err := t.client.Post(t.endpoint, "application/json",
+		bytes.NewReader(j))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s: %s", redactURL(t.endpoint), resp.Status)
+	}
+	return nil
+
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseTraceParent(t *testing.T) {
+
+	for _, c := range []struct {
+		tp            string
+		trace, parent string
+		sampled       bool
+	}{
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+			"4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7", true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00",
+			"4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7", false},
+		{"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-x",
+			"4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7", true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-x",
+			"", "", false},
+		{"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+			"", "", false},
+		{"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+			"", "", false},
+		{"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+			"", "", false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+			"", "", false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e473-00f067aa0ba902b7-01",
+			"", "", false},
+		{"", "", "", false},
+	} {
+		trace, parent, sampled := parseTraceParent(c.tp)
+		if trace != c.trace || parent != c.parent || sampled != c.sampled {
+			t.Errorf("%q: got %q, %q, %v", c.tp, trace, parent, sampled)
+		}
+	}
+
+}
+
+// An event with a sampled trace context gets an enrichment span, exported
+// with the location as attributes.
+func TestEnrichmentSpan(t *testing.T) {
+
+	exports := make(chan otlpExport, 10)
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			var e otlpExport
+			if json.Unmarshal(body, &e) == nil {
+				exports <- e
+			}
+		}))
+	defer srv.Close()
+
+	dir, cleanup := testDir(t)
+	defer cleanup()
+
+	env := testDBEnv(t, dir)
+	env["GEOIP_OTLP_ENDPOINT"] = srv.URL
+	env["GEOIP_OTLP_INTERVAL"] = "10ms"
+	s, closeDBs := testWork(t, env)
+	defer closeDBs()
+
+	// Not sampled, so not traced.
+	testHandle(t, s, `{"id":"1","src":["ipv4:1.2.3.4"],"traceparent":`+
+		`"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00"}`)
+
+	out := testHandle(t, s, `{"id":"2","src":["ipv4:1.2.3.4"],`+
+		`"traceparent":`+
+		`"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"}`)
+	var ev event
+	err := json.Unmarshal(out, &ev)
+	if err != nil || ev.TraceParent == "" {
+		t.Errorf("trace context not passed through: %s", out)
+	}
+
+	var e otlpExport
+	select {
+	case e = <-exports:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no spans exported")
+	}
+
+	if len(e.ResourceSpans) != 1 ||
+		len(e.ResourceSpans[0].ScopeSpans) != 1 ||
+		len(e.ResourceSpans[0].ScopeSpans[0].Spans) != 1 {
+		t.Fatalf("expected one span: %+v", e)
+	}
+	span := e.ResourceSpans[0].ScopeSpans[0].Spans[0]
+	if span.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" ||
+		span.ParentSpanID != "00f067aa0ba902b7" || len(span.SpanID) != 16 ||
+		span.Name != "geoip.enrich" {
+		t.Errorf("span %+v", span)
+	}
+
+	attrs := map[string]otlpValue{}
+	for _, a := range span.Attributes {
+		attrs[a.Key] = a.Value
+	}
+	if v := attrs["geo.src.country"].StringValue; v == nil || *v != "GB" {
+		t.Errorf("geo.src.country %v", v)
+	}
+	if v := attrs["geo.src.asn"].IntValue; v == nil || *v != "64500" {
+		t.Errorf("geo.src.asn %v", v)
+	}
+	if v := attrs["geo.src.source"].StringValue; v == nil ||
+		*v != "database" {
+		t.Errorf("geo.src.source %v", v)
+	}
+	if attrs["geo.lookup.latency_ms"].DoubleValue == nil {
+		t.Error("no lookup latency")
+	}
+	if _, ok := attrs["geo.dest.country"]; ok {
+		t.Error("geo.dest.country set without a destination")
+	}
+
+}
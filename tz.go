@@ -0,0 +1,77 @@
+//
+// Time zone UTC offsets.  The offset depends on the time, because of
+// daylight saving, so it is worked out per event rather than cached with the
+// location.  Loaded zones are cached; there are only a few hundred.
+//
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+var (
+	zones     = map[string]*time.Location{}
+	zonesLock sync.Mutex
+)
+
+// Load a time zone through the cache.  Zones which won't load are cached as
+// nil, so aren't retried for every event.
+func loadZone(name string) *time.Location {
+
+	zonesLock.Lock()
+	defer zonesLock.Unlock()
+
+	if loc, ok := zones[name]; ok {
+		return loc
+	}
+
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		loc = nil
+	}
+	zones[name] = loc
+	return loc
+
+}
+
+// UTC offset of a time zone at a time, e.g. "+01:00", or empty if the zone
+// is unknown.
+func utcOffset(zone string, t time.Time) string {
+	if zone == "" {
+		return ""
+	}
+	loc := loadZone(zone)
+	if loc == nil {
+		return ""
+	}
+	return t.In(loc).Format("-07:00")
+}
+
+// Copy of a location with the UTC offsets at a time filled in.  The original
+// may be shared with the flow cache, so isn't modified.
+func withOffsets(l *locationInfo, t time.Time) *locationInfo {
+
+	c := *l
+	for _, p := range []**place{&c.Src, &c.Dest} {
+		if *p == nil || (*p).TimeZone == "" {
+			continue
+		}
+		cp := **p
+		cp.UTCOffset = utcOffset(cp.TimeZone, t)
+		*p = &cp
+	}
+	return &c
+
+}
+
+// Time of an event for offset purposes: its own time if that parses, else
+// now.
+func eventTime(v string) time.Time {
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return time.Now()
+	}
+	return t
+}
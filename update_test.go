@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// The event fields the update test checks.
+type testOutput struct {
+	Location struct {
+		Src struct {
+			City  string `json:"city"`
+			ASNum uint   `json:"asnum"`
+		} `json:"src"`
+	} `json:"location"`
+}
+
+// Handle an event, returning the location fields of what was sent.
+func handleTest(t *testing.T, s *work, msg string) testOutput {
+	var ev testOutput
+	out := testHandle(t, s, msg)
+	err := json.Unmarshal(out, &ev)
+	if err != nil {
+		t.Fatalf("bad output %q: %s", out, err.Error())
+	}
+	return ev
+}
+
+// geoipupdate replaces the databases, the updater notifies the handler, and
+// the next event is enriched from the new databases.
+func TestUpdateNotifyReopen(t *testing.T) {
+
+	dir, cleanup := testDir(t)
+	defer cleanup()
+
+	city := testDB(t, dir, "GeoLite2-City.mmdb", "GeoLite2-City", 1,
+		[]testNetwork{{"1.2.3.0/24",
+			testCityRecord("GB", "United Kingdom", "London")}})
+	asn := testDB(t, dir, "GeoLite2-ASN.mmdb", "GeoLite2-ASN", 1,
+		[]testNetwork{{"1.2.3.0/24", testASNRecord(64500, "Old Net")}})
+
+	// The stub geoipupdate installs these into the -d directory.
+	next := filepath.Join(dir, "next")
+	err := os.Mkdir(next, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testDB(t, next, "GeoLite2-City.mmdb", "GeoLite2-City", 2,
+		[]testNetwork{{"1.2.3.0/24",
+			testCityRecord("FR", "France", "Paris")}})
+	testDB(t, next, "GeoLite2-ASN.mmdb", "GeoLite2-ASN", 2,
+		[]testNetwork{{"1.2.3.0/24",
+			testASNRecord(64501, "New Network")}})
+
+	stub := filepath.Join(dir, "geoipupdate")
+	err = ioutil.WriteFile(stub, []byte("#!/bin/sh\n"+
+		"while [ $# -gt 0 ]; do\n"+
+		"  if [ \"$1\" = -d ]; then dir=$2; fi; shift\n"+
+		"done\n"+
+		"cp "+next+"/*.mmdb \"$dir\"\n"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oldCommand, oldDir := updateCommand, updateDir
+	updateCommand, updateDir = stub, dir
+	defer func() { updateCommand, updateDir = oldCommand, oldDir }()
+
+	defer setTestEnv(map[string]string{
+		"GEOIP_DB":     city,
+		"GEOIP_ASN_DB": asn,
+	})()
+
+	var s work
+	notif := make(chan bool, 2)
+	err = s.init(notif)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.cityDB.close()
+	defer s.asnDB.close()
+
+	msg := `{"id":"1","src":["ipv4:1.2.3.4"]}`
+	ev := handleTest(t, &s, msg)
+	if ev.Location.Src.City != "London" || ev.Location.Src.ASNum != 64500 {
+		t.Fatalf("before update: got %+v", ev.Location.Src)
+	}
+
+	out, err := runUpdate()
+	if err != nil {
+		t.Fatalf("update: %s: %s", err.Error(), out)
+	}
+	notify(notif)
+
+	ev = handleTest(t, &s, msg)
+	if ev.Location.Src.City != "Paris" || ev.Location.Src.ASNum != 64501 {
+		t.Errorf("after update: got %+v", ev.Location.Src)
+	}
+	if e := s.cityDB.reader.Metadata().BuildEpoch; e != 2 {
+		t.Errorf("City database epoch %d, expected 2", e)
+	}
+	if e := s.asnDB.reader.Metadata().BuildEpoch; e != 2 {
+		t.Errorf("ASN database epoch %d, expected 2", e)
+	}
+
+	// A repeated notification with nothing new changes nothing.
+	notify(notif)
+	ev = handleTest(t, &s, msg)
+	if ev.Location.Src.City != "Paris" {
+		t.Errorf("after repeat notification: got %+v", ev.Location.Src)
+	}
+
+}
+
+// A socket source which couldn't be read at startup is read on a later
+// reload, and not again once it has been.
+func TestUpdateStreamRetry(t *testing.T) {
+
+	dir, cleanup := testDir(t)
+	defer cleanup()
+
+	data, err := ioutil.ReadFile(testDB(t, dir, "isp.mmdb", "GeoIP2-ISP",
+		1, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sock := filepath.Join(dir, "isp.sock")
+	d := newDatabase("ISP", "unix:"+sock, nil)
+	d.edition = "ISP"
+
+	if d.update() != nil {
+		t.Fatalf("update without the socket opened a database")
+	}
+
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write(data)
+			conn.Close()
+		}
+	}()
+
+	db := d.update()
+	if db == nil {
+		t.Fatalf("update with the socket didn't open the database")
+	}
+	d.install(db)
+	defer d.close()
+
+	if d.update() != nil {
+		t.Errorf("loaded socket source was read again")
+	}
+
+}